@@ -0,0 +1,46 @@
+package main
+
+import (
+	"dle-proxy/server"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// dle-proxy sign-url -secret xxx -ttl 24h "/resize/poster-sm/?url=https://imager/posts/1.jpg"
+func signURLCommand(args []string) {
+	fs := flag.NewFlagSet("sign-url", flag.ExitOnError)
+	secret := fs.String("secret", os.Getenv("RESIZE_SECRET"), "domain ResizeSecret (or RESIZE_SECRET env)")
+	ttl := fs.Duration("ttl", 0, "url lifetime, 0 - never expires")
+	fs.Parse(args)
+
+	if *secret == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dle-proxy sign-url -secret SECRET [-ttl 24h] URI...")
+		os.Exit(2)
+	}
+
+	var expires time.Time
+	if *ttl > 0 {
+		expires = time.Now().Add(*ttl)
+	}
+	for _, uri := range fs.Args() {
+		signed, err := server.SignImageURL(*secret, uri, expires)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(signed)
+	}
+}
+
+// dle-proxy export traefik|nginx|caddy > file
+func exportCommand(serverService *server.Service, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dle-proxy export traefik|nginx|caddy")
+		os.Exit(2)
+	}
+	if err := serverService.Export(args[0], os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
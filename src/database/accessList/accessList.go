@@ -0,0 +1,156 @@
+package accessList
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	entries      []*AccessList
+}
+
+// AccessList entry matches client ip by Type: ip, cidr or asn (number, "AS" prefix is fine).
+// DomainId 0 applies to every domain. Action allow or deny, Response for deny: 403 (default), 404, tarpit.
+type AccessList struct {
+	ID       int
+	DomainId int
+	Type     string
+	Value    string
+	Action   string
+	Response string
+	Comment  string
+
+	prefix netip.Prefix
+	asn    uint
+}
+
+func (c *AccessList) TableName() string {
+	return "flix_access_lists"
+}
+
+func (c *AccessList) parse() (err error) {
+	if c.Action != "allow" && c.Action != "deny" {
+		return fmt.Errorf("unknown action %s", c.Action)
+	}
+	value := strings.TrimSpace(c.Value)
+	switch c.Type {
+	case "ip":
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(value); err == nil {
+			addr = addr.Unmap()
+			c.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	case "cidr":
+		if c.prefix, err = netip.ParsePrefix(value); err == nil {
+			c.prefix = c.prefix.Masked()
+		}
+	case "asn":
+		var asn uint64
+		asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+		c.asn = uint(asn)
+	default:
+		err = fmt.Errorf("unknown type %s", c.Type)
+	}
+	return
+}
+
+func (c *AccessList) matches(addr netip.Addr, asn uint) bool {
+	if c.Type == "asn" {
+		return asn != 0 && c.asn == asn
+	}
+	return c.prefix.Contains(addr)
+}
+
+// HasASN reports whether any entry needs the client asn
+func (s *Service) HasASN() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, g := range s.entries {
+		if g.Type == "asn" {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the entry for client addr and asn (0 - unknown) in domainId list, allow entries win over deny
+func (s *Service) Find(domainId int, addr netip.Addr, asn uint) (entry *AccessList, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addr = addr.Unmap()
+	for _, g := range s.entries {
+		if g.DomainId == domainId && g.matches(addr, asn) {
+			if g.Action == "allow" {
+				return g, nil
+			}
+			if entry == nil {
+				entry = g
+			}
+		}
+	}
+	if entry == nil {
+		err = fmt.Errorf("access list entry not found:%d %s %d", domainId, addr, asn)
+	}
+	return
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&AccessList{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*AccessList
+	if err = s.dbService.DB.Find(&dd).Error; err == nil {
+		entries := dd[:0]
+		for _, d := range dd {
+			if err := d.parse(); err != nil {
+				log.Println("access list", d.ID, err)
+				continue
+			}
+			entries = append(entries, d)
+		}
+		s.mu.Lock()
+		s.entries = entries
+		s.mu.Unlock()
+	}
+	return
+}
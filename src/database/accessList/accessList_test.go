@@ -0,0 +1,76 @@
+package accessList
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	entries := []*AccessList{
+		{ID: 1, DomainId: 1, Type: "cidr", Value: "203.0.113.0/24", Action: "deny", Response: "404"},
+		{ID: 2, DomainId: 1, Type: "ip", Value: "203.0.113.7", Action: "allow"},
+		{ID: 3, DomainId: 1, Type: "cidr", Value: "2001:db8::/32", Action: "deny"},
+		{ID: 4, DomainId: 1, Type: "asn", Value: "AS64500", Action: "deny", Response: "tarpit"},
+		{ID: 5, DomainId: 1, Type: "cidr", Value: "198.51.100.77/24", Action: "deny"},
+		{ID: 6, DomainId: 0, Type: "cidr", Value: "0.0.0.0/0", Action: "deny"},
+		{ID: 7, DomainId: 1, Type: "cidr", Value: "10.0.0.0/8", Action: "deny"},
+		{ID: 8, DomainId: 1, Type: "cidr", Value: "10.1.0.0/16", Action: "allow"},
+	}
+	s := &Service{}
+	for _, e := range entries {
+		if err := e.parse(); err != nil {
+			t.Fatal(e.ID, err)
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	tests := []struct {
+		name string
+		list int
+		addr string
+		asn  uint
+		want int // entry id, 0 - not found
+	}{
+		{name: "cidr deny", list: 1, addr: "203.0.113.8", want: 1},
+		{name: "ip allow wins over cidr deny", list: 1, addr: "203.0.113.7", want: 2},
+		{name: "ipv4 mapped", list: 1, addr: "::ffff:203.0.113.8", want: 1},
+		{name: "ipv6 cidr", list: 1, addr: "2001:db8:1::1", want: 3},
+		{name: "asn", list: 1, addr: "192.0.2.1", asn: 64500, want: 4},
+		{name: "unknown asn", list: 1, addr: "192.0.2.1"},
+		{name: "cidr value with host bits is masked", list: 1, addr: "198.51.100.1", want: 5},
+		{name: "wider allow inside deny", list: 1, addr: "10.1.2.3", want: 8},
+		{name: "deny outside allow", list: 1, addr: "10.2.0.1", want: 7},
+		{name: "other domain entries ignored", list: 2, addr: "203.0.113.8"},
+		{name: "global list", list: 0, addr: "203.0.113.8", want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := s.Find(tt.list, netip.MustParseAddr(tt.addr), tt.asn)
+			got := 0
+			if err == nil {
+				got = entry.ID
+			}
+			if got != tt.want {
+				t.Errorf("Find(%d, %s, %d) = entry %d, want %d", tt.list, tt.addr, tt.asn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		entry AccessList
+		err   bool
+	}{
+		{entry: AccessList{Type: "ip", Value: " 192.0.2.1 ", Action: "deny"}},
+		{entry: AccessList{Type: "asn", Value: "as13335", Action: "allow"}},
+		{entry: AccessList{Type: "cidr", Value: "192.0.2.0/33", Action: "deny"}, err: true},
+		{entry: AccessList{Type: "ip", Value: "192.0.2.1", Action: "block"}, err: true},
+		{entry: AccessList{Type: "host", Value: "example.com", Action: "deny"}, err: true},
+	}
+	for _, tt := range tests {
+		if err := tt.entry.parse(); (err != nil) != tt.err {
+			t.Errorf("parse(%s %q %s) = %v, want error %v", tt.entry.Type, tt.entry.Value, tt.entry.Action, err, tt.err)
+		}
+	}
+}
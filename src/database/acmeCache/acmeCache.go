@@ -0,0 +1,56 @@
+package acmeCache
+
+import (
+	"context"
+	"dle-proxy/database"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Service is autocert.Cache stored in mysql, so all proxy instances share certificates
+type Service struct {
+	dbService *database.Service
+}
+
+type AcmeCache struct {
+	Key       string `gorm:"primaryKey;size:255"`
+	Data      []byte
+	UpdatedAt time.Time
+}
+
+func (c *AcmeCache) TableName() string {
+	return "flix_acme_cache"
+}
+
+func (s *Service) Get(ctx context.Context, key string) ([]byte, error) {
+	var row AcmeCache
+	err := s.dbService.DB.WithContext(ctx).Where("`key` = ?", key).First(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.Data, nil
+}
+
+func (s *Service) Put(ctx context.Context, key string, data []byte) error {
+	row := AcmeCache{Key: key, Data: data, UpdatedAt: time.Now()}
+	return s.dbService.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+func (s *Service) Delete(ctx context.Context, key string) error {
+	return s.dbService.DB.WithContext(ctx).Where("`key` = ?", key).Delete(&AcmeCache{}).Error
+}
+
+func NewService(dbService *database.Service) (s *Service, err error) {
+	s = &Service{
+		dbService: dbService,
+	}
+	err = s.dbService.DB.AutoMigrate(&AcmeCache{})
+	return
+}
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"context"
 	"dle-proxy/database"
 	"fmt"
 	"log"
@@ -16,19 +17,32 @@ type Service struct {
 }
 
 type Domain struct {
-	ID             int
-	Title          string
-	HostPublic     string
-	HostPrivate    string
-	Skin           string
-	ServiceDle     string
-	ServiceImager  string
-	ServiceSitemap string
-	ServiceDns     string
-	NewsNumber     int
-	PortPublic     string
-	SchemePublic   string
-	DisallowRobots bool
+	ID                int
+	Title             string
+	HostPublic        string
+	HostPrivate       string
+	Skin              string
+	ServiceDle        string
+	ServiceImager     string
+	ServiceSitemap    string
+	ServiceDns        string
+	NewsNumber        int
+	PortPublic        string
+	SchemePublic      string
+	DisallowRobots    bool
+	ResizeSecret      string // hmac key for /resize/ and /crop/ urls, empty - unsigned urls allowed
+	ResizeHosts       string // comma separated source hosts allowed for resize besides ServiceImager
+	ImageFormats      string // comma separated formats to negotiate by Accept in preference order: avif,webp. empty - off
+	Balance           string // ServiceDle/ServiceImager may list several urls: round-robin (default), least-conn, uri-hash
+	StaleMaxAge       int    // seconds a stored page may be served when dle fails, 0 - off
+	Challenge         bool   // js challenge for every client but verified search bots
+	ChallengeTTL      int    // seconds a passed challenge is valid, 0 - CHALLENGE_TTL
+	HotlinkMode       string // image requests with foreign Referer: 403, placeholder, redirect. empty - off
+	HotlinkAllow      string // comma separated referer hosts allowed besides HostPublic and aliases, *.example.com
+	HotlinkRedirect   string // url for redirect mode, empty - home page
+	HotlinkBlockEmpty bool   // block requests without Referer too
+	HeaderPolicy      string // json response headers policy, see server/headerpolicy.go
+	Cors              string // json cors rules, see server/cors.go
 }
 
 func (c *Domain) TableName() string {
@@ -72,7 +86,7 @@ func (s *Service) GetDomains() (domains []Domain, err error) {
 	return
 }
 
-func NewService(dbService *database.Service, updatePeriod int) (s *Service, err error) {
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
 
 	s = &Service{
 		dbService:    dbService,
@@ -81,14 +95,18 @@ func NewService(dbService *database.Service, updatePeriod int) (s *Service, err
 
 	err = s.loadData()
 
-	go s.loadWorker()
+	go s.loadWorker(ctx)
 
 	return
 }
 
-func (s *Service) loadWorker() {
+func (s *Service) loadWorker(ctx context.Context) {
 	for {
-		time.Sleep(time.Second * s.updatePeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
 		if err := s.loadData(); err != nil {
 			log.Println(err)
 		}
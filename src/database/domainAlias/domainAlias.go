@@ -1,6 +1,7 @@
 package domainAlias
 
 import (
+	"context"
 	"dle-proxy/database"
 	"fmt"
 	"log"
@@ -48,7 +49,7 @@ func (s *Service) GetDomains() (domains []DomainAlias, err error) {
 	return
 }
 
-func NewService(dbService *database.Service, updatePeriod int) (s *Service, err error) {
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
 
 	s = &Service{
 		dbService:    dbService,
@@ -57,14 +58,18 @@ func NewService(dbService *database.Service, updatePeriod int) (s *Service, err
 
 	err = s.loadData()
 
-	go s.loadWorker()
+	go s.loadWorker(ctx)
 
 	return
 }
 
-func (s *Service) loadWorker() {
+func (s *Service) loadWorker(ctx context.Context) {
 	for {
-		time.Sleep(time.Second * s.updatePeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
 		if err := s.loadData(); err != nil {
 			log.Println(err)
 		}
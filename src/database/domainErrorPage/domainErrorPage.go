@@ -0,0 +1,107 @@
+package domainErrorPage
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"html/template"
+	"log"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	pages        []*DomainErrorPage
+}
+
+// DomainErrorPage is html/template with .Status, .StatusText, .RequestID.
+// Status 0 is used for any status without its own page.
+type DomainErrorPage struct {
+	ID       int
+	DomainId int
+	Status   int
+	Body     string
+
+	tpl *template.Template
+}
+
+func (c *DomainErrorPage) TableName() string {
+	return "flix_domain_error_pages"
+}
+
+// Template is Body parsed when the page was loaded
+func (c *DomainErrorPage) Template() *template.Template {
+	return c.tpl
+}
+
+func (s *Service) GetPage(domainId int, status int) (page *DomainErrorPage, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, g := range s.pages {
+		if g.DomainId == domainId && g.Status == status {
+			return g, nil
+		}
+	}
+	for _, g := range s.pages {
+		if g.DomainId == domainId && g.Status == 0 {
+			return g, nil
+		}
+	}
+
+	return nil, fmt.Errorf("error page not found:%d %d", domainId, status)
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&DomainErrorPage{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*DomainErrorPage
+	if err = s.dbService.DB.Find(&dd).Error; err != nil {
+		return
+	}
+
+	pages := dd[:0]
+	for _, d := range dd {
+		if d.tpl, err = template.New("error").Parse(d.Body); err != nil {
+			log.Println("error page", d.ID, err)
+			continue
+		}
+		pages = append(pages, d)
+	}
+	s.mu.Lock()
+	s.pages = pages
+	s.mu.Unlock()
+	return nil
+}
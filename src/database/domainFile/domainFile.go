@@ -1,6 +1,7 @@
 package domainFile
 
 import (
+	"context"
 	"dle-proxy/database"
 	"fmt"
 	"log"
@@ -44,7 +45,7 @@ func (s *Service) GetFile(domainId int, path string) (domain *DomainFile, err er
 	return nil, fmt.Errorf("file not found:%d %s", domainId, path)
 }
 
-func NewService(dbService *database.Service, updatePeriod int) (s *Service, err error) {
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
 
 	s = &Service{
 		dbService:    dbService,
@@ -53,14 +54,18 @@ func NewService(dbService *database.Service, updatePeriod int) (s *Service, err
 
 	err = s.loadData()
 
-	go s.loadWorker()
+	go s.loadWorker(ctx)
 
 	return
 }
 
-func (s *Service) loadWorker() {
+func (s *Service) loadWorker(ctx context.Context) {
 	for {
-		time.Sleep(time.Second * s.updatePeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
 		if err := s.loadData(); err != nil {
 			log.Println(err)
 		}
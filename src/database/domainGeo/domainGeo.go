@@ -0,0 +1,99 @@
+package domainGeo
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	rules        []*DomainGeo
+}
+
+// DomainGeo is a country rule: Countries is comma separated iso codes or * for any,
+// Action block (451), redirect (to TargetDomainId) or pass. DomainId 0 applies to every domain.
+type DomainGeo struct {
+	ID             int
+	DomainId       int
+	Countries      string
+	Action         string
+	TargetDomainId int
+}
+
+func (c *DomainGeo) TableName() string {
+	return "flix_domain_geo"
+}
+
+func (c *DomainGeo) matches(country string) bool {
+	for _, v := range strings.Split(c.Countries, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "*" || (v != "" && v == country) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRule returns the first domain rule matching country, then the first global one
+func (s *Service) GetRule(domainId int, country string) (rule *DomainGeo, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range []int{domainId, 0} {
+		for _, g := range s.rules {
+			if g.DomainId == id && g.matches(country) {
+				return g, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("geo rule not found:%d %s", domainId, country)
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&DomainGeo{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*DomainGeo
+	if err = s.dbService.DB.Order("id").Find(&dd).Error; err == nil {
+		s.mu.Lock()
+		s.rules = dd
+		s.mu.Unlock()
+	}
+	return
+}
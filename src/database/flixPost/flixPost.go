@@ -1,6 +1,7 @@
 package flixPost
 
 import (
+	"context"
 	"dle-proxy/database"
 	"fmt"
 	"log"
@@ -55,20 +56,24 @@ func (s *Service) GetPost(domainID int, u string) (post FlixPost, altName string
 
 }
 
-func NewService(dbService *database.Service, updatePeriod int) (s *Service, err error) {
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
 	s = &Service{
 		dbService:    dbService,
 		updatePeriod: time.Duration(updatePeriod),
 		flixPosts:    make(map[int]FlixPost),
 	}
 	err = s.loadData()
-	go s.loadWorker()
+	go s.loadWorker(ctx)
 	return
 }
 
-func (s *Service) loadWorker() {
+func (s *Service) loadWorker(ctx context.Context) {
 	for {
-		time.Sleep(time.Second * s.updatePeriod)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
 		if err := s.loadData(); err != nil {
 			log.Println(err)
 		}
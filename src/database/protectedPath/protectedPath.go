@@ -0,0 +1,207 @@
+package protectedPath
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	paths        []*ProtectedPath
+	users        []*ProxyUser
+}
+
+// ProtectedPath matches request path with query by Match: prefix or regex. DomainId 0 applies to every domain.
+// Mode: ip (Allow only), basic (http basic auth), cookie (login form on the proxy), deny (always 404).
+// Allow is comma separated ips and cidrs, when set other ips get 404 in any mode.
+type ProtectedPath struct {
+	ID       int
+	DomainId int
+	Match    string
+	Path     string
+	Mode     string
+	Allow    string
+
+	re    *regexp.Regexp
+	allow []netip.Prefix
+}
+
+func (c *ProtectedPath) TableName() string {
+	return "flix_protected_paths"
+}
+
+// ProxyUser is a login for basic and cookie modes, PasswordHash is bcrypt. DomainId 0 - every domain.
+type ProxyUser struct {
+	ID           int
+	DomainId     int
+	Login        string
+	PasswordHash string
+}
+
+func (c *ProxyUser) TableName() string {
+	return "flix_proxy_users"
+}
+
+func (c *ProtectedPath) parse() (err error) {
+	switch c.Match {
+	case "prefix", "":
+	case "regex":
+		if c.re, err = regexp.Compile(c.Path); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unknown match %s", c.Match)
+	}
+	switch c.Mode {
+	case "ip", "basic", "cookie", "deny":
+	default:
+		return fmt.Errorf("unknown mode %s", c.Mode)
+	}
+	if c.Mode == "ip" && strings.TrimSpace(c.Allow) == "" {
+		return fmt.Errorf("mode ip with empty allow")
+	}
+	for _, v := range strings.Split(c.Allow, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		var prefix netip.Prefix
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else if prefix, err = netip.ParsePrefix(v); err != nil {
+			return err
+		}
+		c.allow = append(c.allow, prefix.Masked())
+	}
+	return nil
+}
+
+// deny turns a row that failed to parse into deny for its path: a typo must not open what it protected.
+// Broken regex falls back to its literal start as prefix, which may deny more than the regex did.
+func (c *ProtectedPath) deny() {
+	c.Mode = "deny"
+	if c.Match == "regex" && c.re == nil {
+		p := strings.TrimPrefix(c.Path, "^")
+		if i := strings.IndexAny(p, `\.+*?()|[]{}$`); i >= 0 {
+			p = p[:i]
+		}
+		c.Path = p
+	}
+}
+
+func (c *ProtectedPath) matches(uri string) bool {
+	if c.re != nil {
+		return c.re.MatchString(uri)
+	}
+	return strings.HasPrefix(uri, c.Path)
+}
+
+// Allows reports whether addr passes Allow, empty Allow lets everyone through
+func (c *ProtectedPath) Allows(addr netip.Addr) bool {
+	if len(c.allow) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range c.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPath returns the first domain rule matching uri, then the first global one
+func (s *Service) GetPath(domainId int, uri string) (rule *ProtectedPath, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range []int{domainId, 0} {
+		for _, g := range s.paths {
+			if g.DomainId == id && g.matches(uri) {
+				return g, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("protected path not found:%d %s", domainId, uri)
+}
+
+// GetUser returns domain user by login, then global one
+func (s *Service) GetUser(domainId int, login string) (user *ProxyUser, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range []int{domainId, 0} {
+		for _, g := range s.users {
+			if g.DomainId == id && g.Login == login {
+				return g, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("proxy user not found:%d %s", domainId, login)
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&ProtectedPath{}, &ProxyUser{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*ProtectedPath
+	if err = s.dbService.DB.Order("id").Find(&dd).Error; err != nil {
+		return
+	}
+	var uu []*ProxyUser
+	if err = s.dbService.DB.Find(&uu).Error; err != nil {
+		return
+	}
+
+	paths := dd[:0]
+	for _, d := range dd {
+		if err := d.parse(); err != nil {
+			log.Println("protected path", d.ID, err, "- denying", d.Path)
+			d.deny()
+		}
+		paths = append(paths, d)
+	}
+	s.mu.Lock()
+	s.paths = paths
+	s.users = uu
+	s.mu.Unlock()
+	return
+}
@@ -0,0 +1,92 @@
+package rateLimit
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	limits       []*RateLimit
+}
+
+// RateLimit is a token bucket per client ip for route Kind: search, resize, dle, imager, imaginary, sitemap, stater, all.
+// DomainId 0 applies to every domain without its own limit. Rate 0 - unlimited.
+// Class limits only clients of that class (human, search-bot, fake-search-bot, bot), empty - any.
+type RateLimit struct {
+	ID       int
+	DomainId int
+	Kind     string
+	Class    string
+	Rate     float64 // requests per second
+	Burst    int
+}
+
+func (c *RateLimit) TableName() string {
+	return "flix_rate_limits"
+}
+
+// GetLimit prefers domain rows over global ones, then class rows over any class
+func (s *Service) GetLimit(domainId int, kind string, class string) (limit *RateLimit, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range []int{domainId, 0} {
+		for _, c := range []string{class, ""} {
+			for _, g := range s.limits {
+				if g.DomainId == id && g.Kind == kind && g.Class == c {
+					return g, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("rate limit not found:%d %s %s", domainId, kind, class)
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&RateLimit{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*RateLimit
+	if err = s.dbService.DB.Find(&dd).Error; err == nil {
+		s.mu.Lock()
+		s.limits = dd
+		s.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package wafRule
+
+import (
+	"context"
+	"dle-proxy/database"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Service struct {
+	mu           sync.RWMutex
+	dbService    *database.Service
+	updatePeriod time.Duration
+	rules        []*WafRule
+}
+
+// WafRule matches when all of its non-empty conditions match. Path, Query, HeaderValue and UserAgent
+// are regexps, Query is matched unescaped. HeaderValue empty - HeaderName presence is enough.
+// BodySize matches Content-Length above it, unknown length (chunked body) counts as above.
+// Methods and Classes are comma separated.
+// Action: block, log, challenge, rate-limit (Rate per second, Burst). DryRun only logs.
+// DomainId 0 applies to every domain.
+type WafRule struct {
+	ID          int
+	DomainId    int
+	Name        string
+	Methods     string
+	Path        string
+	Query       string
+	HeaderName  string
+	HeaderValue string
+	UserAgent   string
+	BodySize    int64
+	Classes     string
+	Action      string
+	Rate        float64
+	Burst       int
+	DryRun      bool
+
+	methods     []string
+	classes     []string
+	path        *regexp.Regexp
+	query       *regexp.Regexp
+	headerValue *regexp.Regexp
+	userAgent   *regexp.Regexp
+}
+
+func (c *WafRule) TableName() string {
+	return "flix_waf_rules"
+}
+
+// WafRequest is what rules look at
+type WafRequest struct {
+	Method    string
+	Path      string
+	Query     string
+	Header    http.Header
+	UserAgent string
+	BodySize  int64
+	Class     string
+}
+
+// Compile parses regexps and lists, must be called before Matches
+func (c *WafRule) Compile() (err error) {
+	if c.path, err = compile(c.Path); err != nil {
+		return
+	}
+	if c.query, err = compile(c.Query); err != nil {
+		return
+	}
+	if c.headerValue, err = compile(c.HeaderValue); err != nil {
+		return
+	}
+	if c.userAgent, err = compile(c.UserAgent); err != nil {
+		return
+	}
+	switch c.Action {
+	case "block", "log", "challenge", "rate-limit":
+	default:
+		return fmt.Errorf("unknown action %s", c.Action)
+	}
+	c.methods = splitList(strings.ToUpper(c.Methods))
+	c.classes = splitList(c.Classes)
+	return nil
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+func inList(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *WafRule) Matches(r *WafRequest) bool {
+	if len(c.methods) > 0 && !inList(c.methods, r.Method) {
+		return false
+	}
+	if len(c.classes) > 0 && !inList(c.classes, r.Class) {
+		return false
+	}
+	if c.BodySize > 0 && r.BodySize >= 0 && r.BodySize <= c.BodySize {
+		return false
+	}
+	if c.path != nil && !c.path.MatchString(r.Path) {
+		return false
+	}
+	if c.query != nil && !c.query.MatchString(r.Query) {
+		return false
+	}
+	if c.userAgent != nil && !c.userAgent.MatchString(r.UserAgent) {
+		return false
+	}
+	if c.HeaderName != "" {
+		values := r.Header.Values(c.HeaderName)
+		if len(values) == 0 {
+			return false
+		}
+		if c.headerValue != nil && !c.headerValue.MatchString(strings.Join(values, ", ")) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRules returns domain rules followed by global ones
+func (s *Service) GetRules(domainId int) (rules []*WafRule) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range []int{domainId, 0} {
+		for _, g := range s.rules {
+			if g.DomainId == id {
+				rules = append(rules, g)
+			}
+		}
+	}
+	return
+}
+
+func NewService(ctx context.Context, dbService *database.Service, updatePeriod int) (s *Service, err error) {
+
+	s = &Service{
+		dbService:    dbService,
+		updatePeriod: time.Duration(updatePeriod),
+	}
+
+	if err = s.dbService.DB.AutoMigrate(&WafRule{}); err != nil {
+		return
+	}
+
+	err = s.loadData()
+
+	go s.loadWorker(ctx)
+
+	return
+}
+
+func (s *Service) loadWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * s.updatePeriod):
+		}
+		if err := s.loadData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (s *Service) loadData() (err error) {
+	var dd []*WafRule
+	if err = s.dbService.DB.Order("id").Find(&dd).Error; err == nil {
+		rules := dd[:0]
+		for _, d := range dd {
+			if err := d.Compile(); err != nil {
+				log.Println("waf rule", d.ID, err)
+				continue
+			}
+			rules = append(rules, d)
+		}
+		s.mu.Lock()
+		s.rules = rules
+		s.mu.Unlock()
+	}
+	return
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
 	"dle-proxy/database"
+	"dle-proxy/database/accessList"
 	"dle-proxy/database/domain"
 	"dle-proxy/database/domainAlias"
+	"dle-proxy/database/domainErrorPage"
 	"dle-proxy/database/domainFile"
+	"dle-proxy/database/domainGeo"
 	"dle-proxy/database/flixPost"
+	"dle-proxy/database/protectedPath"
+	"dle-proxy/database/rateLimit"
+	"dle-proxy/database/wafRule"
 	"dle-proxy/server"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"github.com/joho/godotenv"
 )
@@ -27,6 +37,15 @@ func main() {
 		log.Println("Cant load .env: ", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "sign-url" {
+		signURLCommand(os.Args[2:])
+		return
+	}
+
+	// SIGINT/SIGTERM - graceful shutdown, SIGHUP - hand listeners to a new process and shut down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	mysqlURL := os.Getenv("MYSQL_URL")
 	port := os.Getenv("HTTP_PORT")
 
@@ -45,39 +64,101 @@ func main() {
 		log.Println("dbService OK")
 	}
 
-	domainService, err := domain.NewService(dbService, 60)
+	domainService, err := domain.NewService(ctx, dbService, 60)
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		log.Println("domainService OK")
 	}
 
-	domainAliasService, err := domainAlias.NewService(dbService, 60)
+	domainAliasService, err := domainAlias.NewService(ctx, dbService, 60)
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		log.Println("domainAliasService OK")
 	}
 
-	fileService, err := domainFile.NewService(dbService, 60)
+	fileService, err := domainFile.NewService(ctx, dbService, 60)
 	if err != nil {
 		log.Println(err)
 	} else {
 		log.Println("fileService OK")
 	}
 
-	flixPostService, err := flixPost.NewService(dbService, 60)
+	flixPostService, err := flixPost.NewService(ctx, dbService, 60)
 	if err != nil {
 		log.Println(err)
 	} else {
 		log.Println("flixPost OK")
 	}
 
-	serverService, err := server.NewService(port, dbService, domainService, domainAliasService, fileService, flixPostService)
+	errorPageService, err := domainErrorPage.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("errorPageService OK")
+	}
+
+	rateLimitService, err := rateLimit.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("rateLimitService OK")
+	}
+
+	accessListService, err := accessList.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("accessListService OK")
+	}
+
+	geoService, err := domainGeo.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("geoService OK")
+	}
+
+	protectedPathService, err := protectedPath.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("protectedPathService OK")
+	}
+
+	wafService, err := wafRule.NewService(ctx, dbService, 60)
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Println("wafService OK")
+	}
+
+	serverService, err := server.NewService(ctx, port, dbService, domainService, domainAliasService, fileService, flixPostService, errorPageService, rateLimitService, accessListService, geoService, protectedPathService, wafService)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportCommand(serverService, os.Args[2:])
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := serverService.Handoff(); err != nil {
+				log.Println("handoff failed", err)
+				continue
+			}
+			stop()
+		}
+	}()
+
 	log.Println("starting server...")
-	serverService.Run()
+	if err := serverService.Run(ctx); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Error starting proxy server: ", err)
+	}
+	log.Println("STOP")
 
 }
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// GeoLite2-ASN / GeoIP2-ISP record
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// clientASN returns autonomous system number of addr from ASN_DB, 0 - unknown
+func (s *Service) clientASN(addr netip.Addr) uint {
+	var rec asnRecord
+	if err := s.asnDB.lookup(addr, &rec); err != nil {
+		return 0
+	}
+	return rec.Number
+}
+
+// domainIDOf returns id of the domain host belongs to directly or as an alias, 0 - unknown host
+func (s *Service) domainIDOf(host string) int {
+	if dom, err := s.domainService.GetDomain(host); err == nil {
+		return dom.ID
+	}
+	if alias, err := s.domainAliasService.GetDomain(host); err == nil {
+		return alias.DomainID
+	}
+	return 0
+}
+
+// accessDenied checks flix_access_lists of the domain, then the global one. The first list with
+// a matching entry decides, so a domain allow entry lets a globally denied network in.
+func (s *Service) accessDenied(w http.ResponseWriter, r *http.Request, domainID int, c client, requestID string) bool {
+	if s.accessListService == nil {
+		return false
+	}
+	var asn uint
+	if s.asnDB != nil && s.accessListService.HasASN() {
+		asn = s.clientASN(c.ip)
+	}
+
+	lists := []int{domainID, 0}
+	if domainID == 0 {
+		lists = lists[1:]
+	}
+	for _, id := range lists {
+		entry, err := s.accessListService.Find(id, c.ip, asn)
+		if err != nil {
+			continue
+		}
+		if entry.Action == "allow" {
+			return false
+		}
+
+		response := entry.Response
+		if response == "" {
+			response = "403"
+		}
+		log.Printf("%s (%s) %s denied %s AS%d by access list %d, %s\n", r.Method, r.Host, r.URL.String(), c.ip, asn, entry.ID, response)
+		s.metrics.inc("dle_proxy_access_denied_total", "response", response)
+		switch response {
+		case "404":
+			s.errorPage(w, domainID, http.StatusNotFound, requestID)
+		case "tarpit":
+			s.tarpit(w, r, domainID, requestID)
+		default:
+			s.errorPage(w, domainID, http.StatusForbidden, requestID)
+		}
+		return true
+	}
+	return false
+}
+
+// tarpit holds the request for TARPIT_DELAY before answering 403. At most TARPIT_MAX requests
+// are held at once, the rest get 403 right away.
+func (s *Service) tarpit(w http.ResponseWriter, r *http.Request, domainID int, requestID string) {
+	select {
+	case s.tarpitSlots <- struct{}{}:
+		defer func() { <-s.tarpitSlots }()
+		t := time.NewTimer(s.tarpitDelay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	default:
+	}
+	s.errorPage(w, domainID, http.StatusForbidden, requestID)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"dle-proxy/database/acmeCache"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager issues certificates for HostPublic and alias hosts.
+// ACME_CACHE_DIR keeps certs on disk, otherwise they are stored in mysql (flix_acme_cache).
+// ACME_DIRECTORY_URL + ACME_CA_FILE point it to a test CA like pebble.
+func (s *Service) newACMEManager() (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Email:      os.Getenv("ACME_EMAIL"),
+		HostPolicy: s.acmeHostPolicy,
+	}
+
+	if dir := os.Getenv("ACME_CACHE_DIR"); dir != "" {
+		m.Cache = autocert.DirCache(dir)
+	} else {
+		cache, err := acmeCache.NewService(s.dbService)
+		if err != nil {
+			return nil, err
+		}
+		m.Cache = cache
+	}
+
+	if directoryURL := os.Getenv("ACME_DIRECTORY_URL"); directoryURL != "" {
+		client := &acme.Client{DirectoryURL: directoryURL}
+		if caFile := os.Getenv("ACME_CA_FILE"); caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", caFile)
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+		m.Client = client
+	}
+
+	return m, nil
+}
+
+// acmeHostPolicy allows certificates only for hosts from flix_domain and flix_domain_alias
+func (s *Service) acmeHostPolicy(ctx context.Context, host string) error {
+	if _, err := s.domainService.GetDomain(host); err == nil {
+		return nil
+	}
+	if _, err := s.domainAliasService.GetDomain(host); err == nil {
+		return nil
+	}
+	return fmt.Errorf("acme: host not allowed: %s", host)
+}
+
+// setupTLS adds https listener on HTTPS_PORT and http-01 challenge handler on the http listener
+func (s *Service) setupTLS(httpsPort string) error {
+	m, err := s.newACMEManager()
+	if err != nil {
+		return err
+	}
+	s.server.Handler = m.HTTPHandler(s.server.Handler)
+	s.tlsServer = &http.Server{
+		Addr:              fmt.Sprintf(":%s", httpsPort),
+		Handler:           http.HandlerFunc(s.Proxy),
+		TLSConfig:         m.TLSConfig(),
+		ReadHeaderTimeout: s.server.ReadHeaderTimeout,
+		ReadTimeout:       s.server.ReadTimeout,
+		WriteTimeout:      s.server.WriteTimeout,
+		IdleTimeout:       s.server.IdleTimeout,
+	}
+	log.Println("acme enabled, https port", httpsPort)
+	return nil
+}
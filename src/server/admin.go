@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// admin endpoints live under this prefix on every host, protected by ADMIN_TOKEN
+const adminPrefix = "/_proxy/"
+
+// isAdminPath is /_proxy/*. /traefik stays a domain path proxied to flix_domain.service_dns
+// as before, existing traefik http providers keep working until moved to /_proxy/traefik.
+func (s *Service) isAdminPath(path string) bool {
+	return strings.HasPrefix(path, adminPrefix)
+}
+
+func (s *Service) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"traefik", s.traefikHandler)
+	mux.HandleFunc(adminPrefix+"nginx", s.exportHandler("nginx"))
+	mux.HandleFunc(adminPrefix+"caddy", s.exportHandler("caddy"))
+	mux.HandleFunc(adminPrefix+"status", s.statusHandler)
+	mux.HandleFunc(adminPrefix+"metrics", s.metricsHandler)
+	return s.adminAuth(mux)
+}
+
+// adminAuth checks Authorization: Bearer <ADMIN_TOKEN>. Without ADMIN_TOKEN admin is disabled.
+func (s *Service) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dle-proxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
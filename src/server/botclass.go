@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client classes, sent to dle as X-Client-Class
+const (
+	classHuman     = "human"
+	classSearchBot = "search-bot"      // search engine verified by reverse+forward dns
+	classFakeBot   = "fake-search-bot" // claims to be a search engine, dns says otherwise
+	classBot       = "bot"
+)
+
+var clientClasses = []string{classHuman, classSearchBot, classFakeBot, classBot}
+
+type searchBot struct {
+	agents  []string // user agent tokens, lowercase
+	domains []string // reverse dns name must end with one of these
+}
+
+// https://developers.google.com/search/docs/crawling-indexing/verifying-googlebot
+// https://yandex.com/support/webmaster/robot-workings/check-yandex-robots.html
+var searchBots = []searchBot{
+	{[]string{"googlebot", "google-inspectiontool", "storebot-google"}, []string{".googlebot.com", ".google.com", ".googleusercontent.com"}},
+	{[]string{"yandexbot", "yandeximages", "yandexmobilebot", "yandexvideo", "yandexmedia", "yandexrenderresourcesbot"}, []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+	{[]string{"bingbot"}, []string{".search.msn.com"}},
+	{[]string{"applebot"}, []string{".applebot.apple.com"}},
+	{[]string{"mail.ru_bot"}, []string{".mail.ru"}},
+}
+
+var botAgent = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|scrapy|curl|wget|python|go-http-client|java/|libwww|httpclient|okhttp|headless|phantomjs|axios|node-fetch`)
+
+// dns verification results
+const (
+	botVerified   = iota // reverse and forward dns agree
+	botFake              // dns answered and it's not the search engine
+	botUnverified        // lookup failed, we don't know
+)
+
+type botVerdict struct {
+	result  int
+	expires time.Time
+	done    chan struct{} // closed when the lookup finished
+}
+
+// botVerifier checks search bot ips by reverse+forward dns, results are cached per ip
+type botVerifier struct {
+	mu       sync.Mutex
+	resolver *net.Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+	errorTTL time.Duration
+	max      int
+	cache    map[string]*botVerdict
+}
+
+// newBotVerifier uses BOT_DNS_RESOLVER (host:port) when set, system resolver otherwise
+func newBotVerifier() *botVerifier {
+	v := &botVerifier{
+		resolver: net.DefaultResolver,
+		timeout:  envDuration("BOT_DNS_TIMEOUT", 2*time.Second),
+		ttl:      envDuration("BOT_DNS_CACHE_TTL", 6*time.Hour),
+		errorTTL: envDuration("BOT_DNS_ERROR_TTL", 30*time.Second),
+		max:      envInt("BOT_DNS_CACHE_SIZE", 10000),
+		cache:    map[string]*botVerdict{},
+	}
+	if addr := envString("BOT_DNS_RESOLVER", ""); addr != "" {
+		v.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return v
+}
+
+// verify checks that ip reverse resolves to one of domains and that name resolves back to ip.
+// Concurrent requests from the same ip wait for one lookup. Failed lookups are cached for
+// BOT_DNS_ERROR_TTL only, so a resolver hiccup doesn't mark a real crawler fake for hours.
+func (v *botVerifier) verify(ip string, domains []string) int {
+	key := ip + " " + domains[0]
+	now := time.Now()
+
+	v.mu.Lock()
+	verdict, ok := v.cache[key]
+	if ok && (verdict.expires.IsZero() || now.Before(verdict.expires)) {
+		v.mu.Unlock()
+		<-verdict.done
+		return verdict.result
+	}
+	if len(v.cache) >= v.max {
+		v.evict(now)
+	}
+	verdict = &botVerdict{done: make(chan struct{})}
+	v.cache[key] = verdict
+	v.mu.Unlock()
+
+	result := v.lookup(ip, domains)
+
+	v.mu.Lock()
+	verdict.result = result
+	verdict.expires = time.Now().Add(v.ttl)
+	if result == botUnverified {
+		verdict.expires = time.Now().Add(v.errorTTL)
+	}
+	v.mu.Unlock()
+	close(verdict.done)
+	return result
+}
+
+// evict drops expired verdicts, or any if none expired. Called with mu held.
+func (v *botVerifier) evict(now time.Time) {
+	for key, verdict := range v.cache {
+		if !verdict.expires.IsZero() && now.After(verdict.expires) {
+			delete(v.cache, key)
+		}
+	}
+	for key, verdict := range v.cache {
+		if len(v.cache) < v.max {
+			break
+		}
+		if !verdict.expires.IsZero() {
+			delete(v.cache, key)
+		}
+	}
+}
+
+func (v *botVerifier) lookup(ip string, domains []string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	names, err := v.resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		if dnsNotFound(err) {
+			return botFake
+		}
+		log.Println("bot verify", ip, err)
+		return botUnverified
+	}
+	result := botFake
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasDomainSuffix(name, domains) {
+			continue
+		}
+		addrs, err := v.resolver.LookupHost(ctx, name)
+		if err != nil {
+			if !dnsNotFound(err) {
+				log.Println("bot verify", ip, name, err)
+				result = botUnverified
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if parseAddr(addr) == parseAddr(ip) {
+				return botVerified
+			}
+		}
+	}
+	return result
+}
+
+// dnsNotFound is an authoritative "no such name", unlike timeouts and server failures
+func dnsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func hasDomainSuffix(name string, domains []string) bool {
+	for _, d := range domains {
+		if strings.HasSuffix(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify tells humans from bots by User-Agent, search engine claims are checked by dns
+func (s *Service) classify(r *http.Request, c client) string {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return classBot
+	}
+	for _, bot := range searchBots {
+		if !containsAny(ua, bot.agents) {
+			continue
+		}
+		if !c.ip.IsValid() {
+			return classFakeBot
+		}
+		switch s.botVerifier.verify(c.ip.String(), bot.domains) {
+		case botVerified:
+			return classSearchBot
+		case botUnverified:
+			// can't tell, don't block what may be a real crawler
+			return classBot
+		}
+		return classFakeBot
+	}
+	if botAgent.MatchString(ua) {
+		return classBot
+	}
+	return classHuman
+}
+
+func containsAny(s string, tokens []string) bool {
+	for _, t := range tokens {
+		if strings.Contains(s, t) {
+			return true
+		}
+	}
+	return false
+}
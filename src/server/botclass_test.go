@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// verifierWith returns a verifier that answers from cache only
+func verifierWith(results map[string]int) *botVerifier {
+	v := &botVerifier{max: 100, cache: map[string]*botVerdict{}}
+	for key, result := range results {
+		done := make(chan struct{})
+		close(done)
+		v.cache[key] = &botVerdict{result: result, expires: time.Now().Add(time.Hour), done: done}
+	}
+	return v
+}
+
+func TestClassify(t *testing.T) {
+	s := &Service{botVerifier: verifierWith(map[string]int{
+		"66.249.66.1 .googlebot.com":      botVerified,
+		"203.0.113.7 .googlebot.com":      botFake,
+		"198.51.100.1 .googlebot.com":     botUnverified,
+		"2001:db8::1 .search.msn.com":     botVerified,
+		"203.0.113.7 .yandex.ru":          botFake,
+		"5.255.253.1 .yandex.ru":          botVerified,
+		"66.249.66.1 .applebot.apple.com": botFake,
+	})}
+
+	const googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	tests := []struct {
+		name string
+		ip   string
+		ua   string
+		want string
+	}{
+		{name: "browser", ip: "203.0.113.7", ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/128.0", want: classHuman},
+		{name: "empty agent", ip: "203.0.113.7", ua: "", want: classBot},
+		{name: "curl", ip: "203.0.113.7", ua: "curl/8.5.0", want: classBot},
+		{name: "headless", ip: "203.0.113.7", ua: "Mozilla/5.0 HeadlessChrome/120.0", want: classBot},
+		{name: "verified googlebot", ip: "66.249.66.1", ua: googlebot, want: classSearchBot},
+		{name: "fake googlebot", ip: "203.0.113.7", ua: googlebot, want: classFakeBot},
+		{name: "unverifiable googlebot", ip: "198.51.100.1", ua: googlebot, want: classBot},
+		{name: "googlebot without ip", ua: googlebot, want: classFakeBot},
+		{name: "verified bingbot ipv6", ip: "2001:db8::1", ua: "Mozilla/5.0 (compatible; bingbot/2.0)", want: classSearchBot},
+		{name: "fake yandex", ip: "203.0.113.7", ua: "Mozilla/5.0 (compatible; YandexBot/3.0)", want: classFakeBot},
+		{name: "verified yandex images", ip: "5.255.253.1", ua: "Mozilla/5.0 (compatible; YandexImages/3.0)", want: classSearchBot},
+		{name: "google ip claiming applebot", ip: "66.249.66.1", ua: "Mozilla/5.0 (Applebot/0.1)", want: classFakeBot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("User-Agent", tt.ua)
+			var c client
+			if tt.ip != "" {
+				c.ip = netip.MustParseAddr(tt.ip)
+			}
+			if got := s.classify(r, c); got != tt.want {
+				t.Errorf("classify(%s, %q) = %s, want %s", tt.ip, tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotVerifierEvict(t *testing.T) {
+	v := verifierWith(map[string]int{"a": botVerified, "b": botVerified})
+	v.max = 2
+	v.cache["a"].expires = time.Now().Add(-time.Minute)
+	pending := &botVerdict{done: make(chan struct{})}
+	v.cache["pending"] = pending
+
+	v.evict(time.Now())
+	if _, ok := v.cache["a"]; ok {
+		t.Error("expired verdict kept")
+	}
+	if v.cache["pending"] != pending {
+		t.Error("lookup in flight evicted")
+	}
+}
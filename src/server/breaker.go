@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStates = []string{"closed", "half-open", "open"}
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breaker opens after BREAKER_FAILURES consecutive failures of one upstream and rejects requests
+// for BREAKER_OPEN_TIME, then lets a single probe request through (half-open).
+type breaker struct {
+	mu        sync.Mutex
+	backend   string
+	upstream  string
+	state     int
+	failures  int
+	openedAt  time.Time
+	probe     uint64 // ticket of the probe in flight, 0 - none
+	probes    uint64
+	threshold int
+	openTime  time.Duration
+}
+
+// allow returns a ticket for success, failure or release, non-zero when the request is the half-open probe
+func (b *breaker) allow() (ticket uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openTime {
+			return 0, false
+		}
+		b.state = breakerHalfOpen
+		return b.startProbe(), true
+	case breakerHalfOpen:
+		if b.probe != 0 {
+			return 0, false
+		}
+		return b.startProbe(), true
+	}
+	return 0, true
+}
+
+func (b *breaker) startProbe() uint64 {
+	b.probes++
+	b.probe = b.probes
+	return b.probe
+}
+
+// endProbe lets the next probe through when ticket is the one in flight,
+// requests let in before the breaker opened must not end a later probe
+func (b *breaker) endProbe(ticket uint64) {
+	if ticket != 0 && ticket == b.probe {
+		b.probe = 0
+	}
+}
+
+// available reports whether allow would let a request through, unlike allow it changes nothing
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.openTime
+	case breakerHalfOpen:
+		return b.probe == 0
+	}
+	return true
+}
+
+// success closes the breaker whether or not the request was the probe
+func (b *breaker) success(ticket uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probe = 0
+}
+
+// release ends a probe that told nothing about the upstream, like a request cancelled by the client
+func (b *breaker) release(ticket uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endProbe(ticket)
+}
+
+func (b *breaker) failure(ticket uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.endProbe(ticket)
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probe = 0
+	}
+}
+
+type breakerStatus struct {
+	Backend  string `json:"backend"`
+	Upstream string `json:"upstream"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{Backend: b.backend, Upstream: b.upstream, State: breakerStates[b.state], Failures: b.failures}
+}
+
+// breaker returns breaker for backend upstream host, created on first use
+func (s *Service) breaker(backend, upstream string) *breaker {
+	key := backend + " " + upstream
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &breaker{
+			backend:   backend,
+			upstream:  upstream,
+			threshold: s.breakerFailures,
+			openTime:  s.breakerOpenTime,
+		}
+		s.breakers[key] = b
+	}
+	return b
+}
+
+func (s *Service) breakerStatuses() []breakerStatus {
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+	list := make([]breakerStatus, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		list = append(list, b.status())
+	}
+	return list
+}
+
+func (s *Service) updateBreakerMetrics() {
+	for _, st := range s.breakerStatuses() {
+		for state, name := range breakerStates {
+			v := 0.0
+			if st.State == name {
+				v = 1
+			}
+			s.metrics.set("dle_proxy_breaker_state", v, "backend", st.Backend, "upstream", st.Upstream, "state", breakerStates[state])
+		}
+	}
+}
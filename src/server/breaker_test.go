@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerProbe(t *testing.T) {
+	b := &breaker{threshold: 1, openTime: time.Millisecond}
+
+	// let in while closed, finishes after the breaker opened and the probe started
+	early, ok := b.allow()
+	if !ok || early != 0 {
+		t.Fatalf("closed allow = %d %v", early, ok)
+	}
+	first, _ := b.allow()
+	b.failure(first)
+	if _, ok := b.allow(); ok {
+		t.Fatal("open breaker let a request through")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	probe, ok := b.allow()
+	if !ok || probe == 0 {
+		t.Fatalf("half-open allow = %d %v, want probe", probe, ok)
+	}
+	if _, ok := b.allow(); ok {
+		t.Fatal("second request let through during probe")
+	}
+
+	b.release(early)
+	if _, ok := b.allow(); ok {
+		t.Fatal("release of a non-probe request ended the probe")
+	}
+
+	b.release(probe)
+	next, ok := b.allow()
+	if !ok || next == 0 || next == probe {
+		t.Fatalf("allow after probe release = %d %v, want new probe", next, ok)
+	}
+
+	// stale ticket of the released probe changes nothing
+	b.release(probe)
+	if b.available() {
+		t.Fatal("stale probe ticket ended the current probe")
+	}
+
+	b.success(next)
+	if st := b.status(); st.State != "closed" {
+		t.Fatalf("state after probe success = %s", st.State)
+	}
+}
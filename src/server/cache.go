@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheEntry is a response as it was sent to the client (after domain rewriting)
+type cacheEntry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+// same reports equal response, Date aside: storing it again changes nothing but Stored
+func (e *cacheEntry) same(o *cacheEntry) bool {
+	if e.Status != o.Status || !bytes.Equal(e.Body, o.Body) {
+		return false
+	}
+	for _, h := range []http.Header{e.Header, o.Header} {
+		for name := range h {
+			if name != "Date" && !slices.Equal(e.Header[name], o.Header[name]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Body))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry // nil for disk items
+	// disk items: last write by this process, zero for files found at start
+	written time.Time
+	// disk items: Stored of the last unchanged set that skipped the write, unix nanoseconds
+	refreshed atomic.Int64
+}
+
+// lru keeps items ordered by use and drops the oldest when size goes over max
+type lru struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+	evict func(key string) // called with mu held
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lru) get(key string) (*lruItem, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+func (c *lru) add(item *lruItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[item.key]; ok {
+		c.size -= el.Value.(*lruItem).size
+		c.ll.Remove(el)
+	}
+	c.items[item.key] = c.ll.PushFront(item)
+	c.size += item.size
+	for c.size > c.max && c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	item := el.Value.(*lruItem)
+	c.ll.Remove(el)
+	delete(c.items, item.key)
+	c.size -= item.size
+	if c.evict != nil {
+		c.evict(item.key)
+	}
+}
+
+// diskStore keeps gob encoded entries under dir/<kind>/ab/cd/<sha256 of key>.
+// Every kind has its own size quota so images can't push pages out. Files are written
+// via temp+rename, the index is rebuilt from the directory at start, mtime is the lru order.
+// An unchanged entry is written again at most once per rewrite, in between it only counts as a hit
+// and its new Stored time is kept in the index.
+type diskStore struct {
+	dir     string
+	mu      sync.Mutex
+	indexes map[string]*lru
+	quota   func(kind string) int64
+	rewrite time.Duration
+}
+
+func newDiskStore(dir string, quota func(kind string) int64, rewrite time.Duration) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &diskStore{dir: dir, indexes: map[string]*lru{}, quota: quota, rewrite: rewrite}
+	if err := d.reindex(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *diskStore) index(kind string) *lru {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	index, ok := d.indexes[kind]
+	if !ok {
+		index = newLRU(d.quota(kind))
+		index.evict = func(name string) {
+			os.Remove(d.path(kind, name))
+		}
+		d.indexes[kind] = index
+	}
+	return index
+}
+
+func diskName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskStore) path(kind, name string) string {
+	return filepath.Join(d.dir, kind, name[0:2], name[2:4], name)
+}
+
+type diskFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// reindex loads existing files oldest first, so the lru order survives restarts
+func (d *diskStore) reindex() error {
+	kinds, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, k := range kinds {
+		if !k.IsDir() {
+			continue
+		}
+		kind := k.Name()
+		var files []diskFile
+		err := filepath.WalkDir(filepath.Join(d.dir, kind), func(path string, entry os.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") {
+				// temp file of an interrupted write
+				os.Remove(path)
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			files = append(files, diskFile{name: name, size: info.Size(), modTime: info.ModTime()})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+		index := d.index(kind)
+		for _, f := range files {
+			index.add(&lruItem{key: f.name, size: f.size})
+		}
+		log.Printf("cache %s: %d files, %d bytes\n", kind, len(files), index.size)
+	}
+	return nil
+}
+
+func (d *diskStore) get(kind, key string) (*cacheEntry, bool) {
+	name := diskName(key)
+	index := d.index(kind)
+	item, ok := index.get(name)
+	if !ok {
+		return nil, false
+	}
+	path := d.path(kind, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		index.remove(name)
+		return nil, false
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil || e.Key != key {
+		index.remove(name)
+		return nil, false
+	}
+	if refreshed := item.refreshed.Load(); refreshed > e.Stored.UnixNano() {
+		e.Stored = time.Unix(0, refreshed)
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &e, true
+}
+
+func (d *diskStore) set(kind, key string, e *cacheEntry, unchanged bool) {
+	name := diskName(key)
+	index := d.index(kind)
+	if item, ok := index.get(name); ok && unchanged && time.Since(item.written) < d.rewrite {
+		// the file keeps its old Stored, get takes this one instead
+		item.refreshed.Store(e.Stored.UnixNano())
+		now := time.Now()
+		os.Chtimes(d.path(kind, name), now, now)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		log.Println("cache", key, err)
+		return
+	}
+	path := d.path(kind, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Println("cache", key, err)
+		return
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		log.Println("cache", key, err)
+		return
+	}
+	index.add(&lruItem{key: name, size: int64(buf.Len()), written: time.Now()})
+}
+
+// responseCache is memory lru with optional disk tier behind it, both split by route kind
+type responseCache struct {
+	mu          sync.Mutex
+	memory      map[string]*lru
+	memoryQuota func(kind string) int64
+	disk        *diskStore
+}
+
+func (c *responseCache) memoryLRU(kind string) *lru {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.memory[kind]
+	if !ok {
+		m = newLRU(c.memoryQuota(kind))
+		c.memory[kind] = m
+	}
+	return m
+}
+
+func (c *responseCache) get(kind, key string) (*cacheEntry, bool) {
+	memory := c.memoryLRU(kind)
+	if item, ok := memory.get(key); ok {
+		return item.entry, true
+	}
+	if c.disk == nil {
+		return nil, false
+	}
+	e, ok := c.disk.get(kind, key)
+	if ok {
+		memory.add(&lruItem{key: key, size: e.size(), entry: e})
+	}
+	return e, ok
+}
+
+func (c *responseCache) set(kind, key string, e *cacheEntry) {
+	e.Key = key
+	memory := c.memoryLRU(kind)
+	unchanged := false
+	if item, ok := memory.get(key); ok {
+		unchanged = item.entry.same(e)
+	}
+	memory.add(&lruItem{key: key, size: e.size(), entry: e})
+	if c.disk != nil {
+		c.disk.set(kind, key, e, unchanged)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiskStoreUnchangedStored(t *testing.T) {
+	quota := func(kind string) int64 { return 1 << 20 }
+	d, err := newDiskStore(t.TempDir(), quota, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := time.Now().Add(-time.Minute).Round(0)
+	d.set(backendDle, "1 /", &cacheEntry{Key: "1 /", Status: 200, Body: []byte("page"), Stored: first}, false)
+	second := time.Now().Round(0)
+	d.set(backendDle, "1 /", &cacheEntry{Key: "1 /", Status: 200, Body: []byte("page"), Stored: second}, true)
+
+	e, ok := d.get(backendDle, "1 /")
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	if !e.Stored.Equal(second) {
+		t.Errorf("Stored = %s, want %s of the unchanged set", e.Stored, second)
+	}
+
+	// after a restart the file has the older Stored until the next set writes it, files found at start are always rewritten
+	d, err = newDiskStore(d.dir, quota, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok = d.get(backendDle, "1 /"); !ok || !e.Stored.Equal(first) {
+		t.Errorf("after reindex Stored = %v %v, want %s", e, ok, first)
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import "text/template"
+
+var caddyTemplate = template.Must(template.New("caddy").Funcs(exportFuncs).Parse(`# generated by dle-proxy, do not edit
+{{range .Sites}}
+{{.Host}} {
+	reverse_proxy {{$.Upstream}}
+}
+{{- if .Aliases}}
+
+{{join .Aliases ", "}} {
+	redir https://{{.Host}}{uri} permanent
+}
+{{- end}}
+{{end}}`))
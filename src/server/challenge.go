@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"dle-proxy/database/domain"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the interstitial sends the browser here, it checks the page token and sets the pass cookie
+const challengePath = "/_challenge/verify"
+
+const challengeCookie = "dle_proxy_pass"
+
+// how long a challenge page token may be exchanged for the cookie
+const challengeTokenTTL = 5 * time.Minute
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Checking your browser</title></head>
+<body style="font-family:sans-serif;text-align:center;padding-top:10%">
+<p id="m">Checking your browser...</p>
+<noscript><p>Please enable JavaScript and reload the page.</p></noscript>
+<script>
+if (navigator.cookieEnabled) {
+	location.replace({{.Path}} + "?t=" + encodeURIComponent({{.Token}}) + "&next=" + encodeURIComponent({{.Next}}));
+} else {
+	document.getElementById("m").textContent = "Please enable cookies and reload the page.";
+}
+</script>
+</body>
+</html>
+`))
+
+var challengeFailedPage = template.Must(template.New("challenge-failed").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Check failed</title></head>
+<body style="font-family:sans-serif;text-align:center;padding-top:10%">
+<p>Browser check failed or expired.</p>
+<p><a href="{{.Next}}">Try again</a></p>
+</body>
+</html>
+`))
+
+type challengePageData struct {
+	Path  string
+	Token string
+	Next  string
+}
+
+// challengeSignature binds page tokens and pass cookies to the domain, client network and user agent
+func (s *Service) challengeSignature(kind string, dom domain.Domain, r *http.Request, c client, expires int64) string {
+	mac := hmac.New(sha256.New, s.authSecret)
+	fmt.Fprintf(mac, "%s|%d|%s|%s|%d", kind, dom.ID, limitAddr(c.ip), r.UserAgent(), expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) challengeToken(kind string, dom domain.Domain, r *http.Request, c client, expires time.Time) string {
+	return strconv.FormatInt(expires.Unix(), 10) + "|" + s.challengeSignature(kind, dom, r, c, expires.Unix())
+}
+
+// challengeTokenValid checks <expires>|<signature> of kind
+func (s *Service) challengeTokenValid(token, kind string, dom domain.Domain, r *http.Request, c client) bool {
+	expiresStr, sig, ok := strings.Cut(token, "|")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.challengeSignature(kind, dom, r, c, expires)))
+}
+
+// challengeTTL is flix_domain.challenge_ttl seconds or CHALLENGE_TTL
+func (s *Service) challengeTTL(dom domain.Domain) time.Duration {
+	if dom.ChallengeTTL > 0 {
+		return time.Duration(dom.ChallengeTTL) * time.Second
+	}
+	return s.challengeCookieTTL
+}
+
+// warnChallengeSecret logs flix_domain.challenge and waf challenge rules that stay off without AUTH_SECRET:
+// a random secret differs between replicas and restarts, tokens wouldn't verify and clients would loop.
+// The rest of the proxy works, so it's no reason to refuse to start.
+func (s *Service) warnChallengeSecret() {
+	if !s.challengeOff {
+		return
+	}
+	domains, err := s.domainService.GetDomains()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	logged := map[int]bool{}
+	for _, dom := range domains {
+		if dom.Challenge {
+			log.Printf("flix_domain %s: challenge is off, it needs AUTH_SECRET\n", dom.HostPublic)
+		}
+		if s.wafService == nil {
+			continue
+		}
+		for _, rule := range s.wafService.GetRules(dom.ID) {
+			if rule.Action == "challenge" && !logged[rule.ID] {
+				logged[rule.ID] = true
+				log.Printf("flix_waf_rules %d: challenge is off, it needs AUTH_SECRET\n", rule.ID)
+			}
+		}
+	}
+}
+
+// navigation reports a request a browser makes to show a page, the only kind the interstitial can help
+func navigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	mode := r.Header.Get("Sec-Fetch-Mode")
+	return mode == "" || mode == "navigate"
+}
+
+// challenge serves the interstitial to clients without a valid pass cookie, true when answered.
+// Verified search bots and RATE_LIMIT_ALLOWLIST clients are never challenged. Ajax and form posts
+// can't run it and get 403 instead.
+func (s *Service) challenge(w http.ResponseWriter, r *http.Request, dom domain.Domain, c client, class, requestID string) bool {
+	if s.challengeOff {
+		// see warnChallengeSecret
+		log.Printf("(%s) challenge skipped, AUTH_SECRET is not set\n", dom.HostPublic)
+		return false
+	}
+	if class == classSearchBot || containsAddr(s.rateLimitAllow, c.ip) {
+		return false
+	}
+	if cookie, err := r.Cookie(challengeCookie); err == nil && s.challengeTokenValid(cookie.Value, "pass", dom, r, c) {
+		return false
+	}
+	if !navigation(r) {
+		s.metrics.inc("dle_proxy_challenge_total", "domain", dom.HostPublic, "result", "refused")
+		s.errorPage(w, dom.ID, http.StatusForbidden, requestID)
+		return true
+	}
+
+	s.metrics.inc("dle_proxy_challenge_total", "domain", dom.HostPublic, "result", "issued")
+	data := challengePageData{
+		Path:  challengePath,
+		Token: s.challengeToken("page", dom, r, c, time.Now().Add(challengeTokenTTL)),
+		Next:  r.URL.RequestURI(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	challengePage.Execute(w, data)
+	return true
+}
+
+// challengeVerify exchanges a page token for the pass cookie and sends the client back.
+// A bad or expired token gets a page with a link, not a redirect that may challenge again in a loop.
+func (s *Service) challengeVerify(w http.ResponseWriter, r *http.Request, dom domain.Domain, c client) {
+	next := localRedirect(r.URL.Query().Get("next"))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !s.challengeTokenValid(r.URL.Query().Get("t"), "page", dom, r, c) {
+		log.Printf("%s (%s) challenge failed %s %q\n", r.Method, dom.HostPublic, c.ip, r.UserAgent())
+		s.metrics.inc("dle_proxy_challenge_total", "domain", dom.HostPublic, "result", "failed")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		challengeFailedPage.Execute(w, challengePageData{Next: next})
+		return
+	}
+
+	ttl := s.challengeTTL(dom)
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    s.challengeToken("pass", dom, r, c, time.Now().Add(ttl)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   c.proto == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.metrics.inc("dle_proxy_challenge_total", "domain", dom.HostPublic, "result", "passed")
+	http.Redirect(w, r, next, http.StatusFound)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const challengeTestUA = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+
+func challengeTestRequest(ua string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/news/1.html", nil)
+	r.Header.Set("User-Agent", ua)
+	return r
+}
+
+func TestChallengeToken(t *testing.T) {
+	s := &Service{authSecret: []byte("secret")}
+	dom := domain.Domain{ID: 1, HostPublic: "example.com"}
+	c := client{ip: netip.MustParseAddr("2001:db8:1:2::10")}
+	r := challengeTestRequest(challengeTestUA)
+	token := s.challengeToken("page", dom, r, c, time.Now().Add(time.Minute))
+	expires, sig, _ := strings.Cut(token, "|")
+	tampered := "A" + sig[1:]
+	if sig[0] == 'A' {
+		tampered = "B" + sig[1:]
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		kind  string
+		dom   domain.Domain
+		ip    string
+		ua    string
+		valid bool
+	}{
+		{name: "round trip", valid: true},
+		{name: "same /64", ip: "2001:db8:1:2::99", valid: true},
+		{name: "different /64", ip: "2001:db8:1:3::10"},
+		{name: "ipv4", ip: "203.0.113.7"},
+		{name: "different user agent", ua: challengeTestUA + " evil"},
+		{name: "other domain", dom: domain.Domain{ID: 2}},
+		{name: "page token as pass cookie", kind: "pass"},
+		{name: "tampered signature", token: expires + "|" + tampered},
+		{name: "tampered expiry", token: strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + "|" + sig},
+		{name: "expired", token: s.challengeToken("page", dom, r, c, time.Now().Add(-time.Second))},
+		{name: "other secret", token: (&Service{authSecret: []byte("other")}).challengeToken("page", dom, r, c, time.Now().Add(time.Minute))},
+		{name: "no separator", token: expires + sig},
+		{name: "empty", token: "|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = s.challengeToken("page", dom, r, c, time.Now().Add(time.Minute))
+			}
+			kind := tt.kind
+			if kind == "" {
+				kind = "page"
+			}
+			d := dom
+			if tt.dom.ID != 0 {
+				d = tt.dom
+			}
+			vc := c
+			if tt.ip != "" {
+				vc.ip = netip.MustParseAddr(tt.ip)
+			}
+			vr := r
+			if tt.ua != "" {
+				vr = challengeTestRequest(tt.ua)
+			}
+			if got := s.challengeTokenValid(token, kind, d, vr, vc); got != tt.valid {
+				t.Errorf("valid = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestChallengeFlow(t *testing.T) {
+	s := &Service{authSecret: []byte("secret"), metrics: newMetricSet(), challengeCookieTTL: time.Hour}
+	// no ID, error pages are the default ones
+	dom := domain.Domain{HostPublic: "example.com", Challenge: true}
+	c := client{ip: netip.MustParseAddr("203.0.113.7"), proto: "https"}
+
+	w := httptest.NewRecorder()
+	if !s.challenge(w, challengeTestRequest(challengeTestUA), dom, c, classHuman, "req") || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first visit: status %d, want the challenge page", w.Code)
+	}
+	token := s.challengeToken("page", dom, challengeTestRequest(challengeTestUA), c, time.Now().Add(time.Minute))
+
+	verify := httptest.NewRequest(http.MethodGet, challengePath+"?t="+token+"&next=%2F%09%2Fevil.com", nil)
+	verify.Header.Set("User-Agent", challengeTestUA)
+	w = httptest.NewRecorder()
+	s.challengeVerify(w, verify, dom, c)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("verify: %d Location %q, want 302 to /", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != challengeCookie || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("verify cookies = %v", cookies)
+	}
+
+	r := challengeTestRequest(challengeTestUA)
+	r.AddCookie(cookies[0])
+	if s.challenge(httptest.NewRecorder(), r, dom, c, classHuman, "req") {
+		t.Error("pass cookie not accepted")
+	}
+	r = challengeTestRequest(challengeTestUA + " other")
+	r.AddCookie(cookies[0])
+	if !s.challenge(httptest.NewRecorder(), r, dom, c, classHuman, "req") {
+		t.Error("pass cookie accepted from another user agent")
+	}
+
+	ajax := challengeTestRequest(challengeTestUA)
+	ajax.Header.Set("X-Requested-With", "XMLHttpRequest")
+	w = httptest.NewRecorder()
+	if !s.challenge(w, ajax, dom, c, classHuman, "req") || w.Code != http.StatusForbidden {
+		t.Errorf("ajax without pass: %d, want 403", w.Code)
+	}
+	if s.challenge(httptest.NewRecorder(), challengeTestRequest(challengeTestUA), dom, c, classSearchBot, "req") {
+		t.Error("verified search bot challenged")
+	}
+}
+
+func TestChallengeWithoutSecret(t *testing.T) {
+	s := &Service{challengeOff: true, metrics: newMetricSet(), domainService: &domain.Service{}}
+	s.warnChallengeSecret()
+
+	dom := domain.Domain{ID: 1, HostPublic: "example.com", Challenge: true}
+	w := httptest.NewRecorder()
+	if s.challenge(w, challengeTestRequest(challengeTestUA), dom, client{}, classHuman, "req") {
+		t.Errorf("challenge served without AUTH_SECRET: %d", w.Code)
+	}
+}
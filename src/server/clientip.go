@@ -0,0 +1,178 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// https://www.cloudflare.com/ips/
+var cloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+var privateRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+var loopbackRanges = []string{"127.0.0.0/8", "::1/128"}
+
+// headers we always set ourselves, incoming values are dropped
+var forwardedHeaders = map[string]bool{
+	"X-Client-Class":    true,
+	"X-Country":         true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+	"X-Real-Ip":         true,
+	"Forwarded":         true,
+}
+
+// headers only cloudflare may set, see client.cloudflare
+var trustedOnlyHeaders = map[string]bool{
+	"Cf-Connecting-Ip": true,
+	"Cf-Ipcountry":     true,
+}
+
+// parsePrefixes parses TRUSTED_PROXIES: CIDRs, ips and keywords cloudflare, private, loopback
+func parsePrefixes(list []string) (prefixes []netip.Prefix) {
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var items []string
+		switch item {
+		case "cloudflare":
+			items = cloudflareRanges
+		case "private":
+			items = privateRanges
+		case "loopback":
+			items = loopbackRanges
+		default:
+			items = []string{item}
+		}
+		for _, v := range items {
+			if !strings.Contains(v, "/") {
+				if addr, err := netip.ParseAddr(v); err == nil {
+					prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+					continue
+				}
+			}
+			prefix, err := netip.ParsePrefix(v)
+			if err != nil {
+				log.Println("bad cidr", v, err)
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// client is who made the request as far as we can trust the headers
+type client struct {
+	ip      netip.Addr // real client ip
+	peer    netip.Addr // tcp peer, proxy or the client itself
+	trusted bool       // peer is a trusted proxy
+	// hop in front of our own proxies is in CLOUDFLARE_PROXIES, its CF-* headers count
+	cloudflare bool
+	proto      string // scheme the client used
+}
+
+func parseAddr(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, _ := netip.ParseAddr(strings.Trim(s, "[]"))
+	return addr.Unmap()
+}
+
+// clientOf derives the real client ip. X-Forwarded-For is used only when the peer is a trusted proxy
+// and is walked from the right skipping trusted hops. CF-Connecting-IP is used only when the walk
+// stops at a CLOUDFLARE_PROXIES address, anyone else could have set it.
+func (s *Service) clientOf(r *http.Request) client {
+	c := client{peer: parseAddr(r.RemoteAddr), proto: "http"}
+	if r.TLS != nil {
+		c.proto = "https"
+	}
+	c.ip = c.peer
+	c.trusted = c.peer.IsValid() && containsAddr(s.trustedProxies, c.peer)
+	if c.trusted {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			c.proto = proto
+		}
+
+		var chain []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+		for i := len(chain) - 1; i >= 0 && !containsAddr(s.cloudflareProxies, c.ip); i-- {
+			addr := parseAddr(chain[i])
+			if !addr.IsValid() {
+				break
+			}
+			c.ip = addr
+			if !containsAddr(s.trustedProxies, addr) {
+				break
+			}
+		}
+	}
+
+	if containsAddr(s.cloudflareProxies, c.ip) {
+		c.cloudflare = true
+		if cf := parseAddr(r.Header.Get("Cf-Connecting-Ip")); cf.IsValid() {
+			c.ip = cf
+		}
+	}
+	return c
+}
+
+// requestHost is Host, or X-Forwarded-Host from a trusted proxy, without port
+func requestHost(r *http.Request, c client) string {
+	host := r.Host
+	if xfh := r.Header.Get("X-Forwarded-Host"); xfh != "" && c.trusted {
+		host = strings.TrimSpace(strings.Split(xfh, ",")[0])
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// setForwardedHeaders writes X-Forwarded-*, X-Real-IP and Forwarded for the backend
+func setForwardedHeaders(h http.Header, r *http.Request, c client, host string) {
+	xff := c.peer.String()
+	if prior := r.Header.Values("X-Forwarded-For"); c.trusted && len(prior) > 0 {
+		// If we aren't the first proxy retain prior
+		// X-Forwarded-For information as a comma+space
+		// separated list and fold multiple headers into one.
+		xff = strings.Join(prior, ", ") + ", " + xff
+	}
+	h.Set("X-Forwarded-For", xff)
+	h.Set("X-Real-Ip", c.ip.String())
+	h.Set("X-Forwarded-Proto", c.proto)
+	h.Set("X-Forwarded-Host", host)
+
+	forwardedFor := c.ip.String()
+	if c.ip.Is6() {
+		forwardedFor = `"[` + forwardedFor + `]"`
+	}
+	h.Set("Forwarded", "for="+forwardedFor+";host="+host+";proto="+c.proto)
+}
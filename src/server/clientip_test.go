@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientOf(t *testing.T) {
+	s := &Service{
+		trustedProxies:    parsePrefixes([]string{"10.0.0.0/8", "loopback"}),
+		cloudflareProxies: parsePrefixes([]string{"cloudflare"}),
+	}
+
+	tests := []struct {
+		name       string
+		remote     string
+		xff        []string
+		cf         string
+		proto      string
+		ip         string
+		trusted    bool
+		cloudflare bool
+		wantProto  string
+	}{
+		{name: "direct", remote: "203.0.113.7:1234", ip: "203.0.113.7", wantProto: "http"},
+		{name: "spoofed xff from untrusted peer", remote: "203.0.113.7:1234", xff: []string{"1.2.3.4"}, proto: "https", ip: "203.0.113.7", wantProto: "http"},
+		{name: "spoofed cf header from untrusted peer", remote: "203.0.113.7:1234", cf: "1.2.3.4", ip: "203.0.113.7", wantProto: "http"},
+		{name: "trusted proxy", remote: "10.0.0.2:1234", xff: []string{"198.51.100.1"}, proto: "https", ip: "198.51.100.1", trusted: true, wantProto: "https"},
+		{name: "client prepends fake hop", remote: "10.0.0.2:1234", xff: []string{"1.2.3.4, 198.51.100.1"}, ip: "198.51.100.1", trusted: true, wantProto: "http"},
+		{name: "trusted hops skipped", remote: "127.0.0.1:1234", xff: []string{"198.51.100.1, 10.0.0.3", "10.0.0.2"}, ip: "198.51.100.1", trusted: true, wantProto: "http"},
+		{name: "garbage stops the walk", remote: "10.0.0.2:1234", xff: []string{"198.51.100.1, junk, 10.0.0.3"}, ip: "10.0.0.3", trusted: true, wantProto: "http"},
+		{name: "bad proto ignored", remote: "10.0.0.2:1234", proto: "gopher", ip: "10.0.0.2", trusted: true, wantProto: "http"},
+		{name: "cloudflare direct", remote: "173.245.48.1:1234", cf: "198.51.100.1", ip: "198.51.100.1", cloudflare: true, wantProto: "http"},
+		{name: "cloudflare behind trusted proxy", remote: "10.0.0.2:1234", xff: []string{"1.2.3.4, 173.245.48.1"}, cf: "198.51.100.1", ip: "198.51.100.1", trusted: true, cloudflare: true, wantProto: "http"},
+		{name: "cf header from a client behind trusted proxy", remote: "10.0.0.2:1234", xff: []string{"203.0.113.7"}, cf: "1.2.3.4", ip: "203.0.113.7", trusted: true, wantProto: "http"},
+		{name: "ipv4 mapped peer", remote: "[::ffff:203.0.113.7]:1234", ip: "203.0.113.7", wantProto: "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.cf != "" {
+				r.Header.Set("Cf-Connecting-Ip", tt.cf)
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			c := s.clientOf(r)
+			if c.ip.String() != tt.ip || c.trusted != tt.trusted || c.cloudflare != tt.cloudflare || c.proto != tt.wantProto {
+				t.Errorf("client = %s trusted %v cloudflare %v proto %s, want %s %v %v %s",
+					c.ip, c.trusted, c.cloudflare, c.proto, tt.ip, tt.trusted, tt.cloudflare, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		xfh     string
+		trusted bool
+		want    string
+	}{
+		{host: "Example.com:8080", want: "example.com"},
+		{host: "example.com", xfh: "evil.com", want: "example.com"},
+		{host: "example.com", xfh: "other.com, evil.com", trusted: true, want: "other.com"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tt.host
+		if tt.xfh != "" {
+			r.Header.Set("X-Forwarded-Host", tt.xfh)
+		}
+		if got := requestHost(r, client{trusted: tt.trusted}); got != tt.want {
+			t.Errorf("requestHost(%q, %q, trusted %v) = %q, want %q", tt.host, tt.xfh, tt.trusted, got, tt.want)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	s := &Service{trustedProxies: parsePrefixes([]string{"10.0.0.0/8"})}
+
+	tests := []struct {
+		name      string
+		remote    string
+		xff       string
+		wantXFF   string
+		forwarded string
+	}{
+		{name: "untrusted prior dropped", remote: "203.0.113.7:1", xff: "1.2.3.4", wantXFF: "203.0.113.7", forwarded: "for=203.0.113.7;host=example.com;proto=http"},
+		{name: "trusted prior kept", remote: "10.0.0.2:1", xff: "198.51.100.1", wantXFF: "198.51.100.1, 10.0.0.2", forwarded: "for=198.51.100.1;host=example.com;proto=http"},
+		{name: "ipv6 quoted", remote: "[2001:db8::1]:1", wantXFF: "2001:db8::1", forwarded: `for="[2001:db8::1]";host=example.com;proto=http`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			h := http.Header{}
+			setForwardedHeaders(h, r, s.clientOf(r), "example.com")
+			if got := h.Get("X-Forwarded-For"); got != tt.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", got, tt.wantXFF)
+			}
+			if got := h.Get("Forwarded"); got != tt.forwarded {
+				t.Errorf("Forwarded = %q, want %q", got, tt.forwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// corsRule is an entry of flix_domain.cors json array, CORS_POLICY is used for domains without one:
+//
+//	[{"path": "/engine/ajax/", "origins": ["$aliases", "$siblings", "https://front.example.com", "*.example.org"],
+//	  "methods": ["GET", "POST"], "headers": ["X-Requested-With", "Content-Type"], "exposeHeaders": [],
+//	  "credentials": true, "maxAge": 600}]
+//
+// The first rule with matching path prefix is used. Origins are full origins, hosts (*.example.org
+// for subdomains), * for any, $self, $aliases (of the domain) or $siblings (any domain behind the proxy).
+// headers ["*"] allows whatever the preflight asks for. * is dropped from rules with credentials,
+// any site could read logged in responses otherwise.
+type corsRule struct {
+	Path          string   `json:"path"`
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"exposeHeaders"`
+	Credentials   bool     `json:"credentials"`
+	MaxAge        int      `json:"maxAge"`
+}
+
+// corsPolicies caches parsed rules by their json
+type corsPolicies struct {
+	base   []corsRule
+	mu     sync.Mutex
+	parsed map[string][]corsRule
+}
+
+func newCorsPolicies() *corsPolicies {
+	cp := &corsPolicies{parsed: map[string][]corsRule{}}
+	if v := envString("CORS_POLICY", ""); v != "" {
+		if err := json.Unmarshal([]byte(v), &cp.base); err != nil {
+			log.Println("bad CORS_POLICY", err)
+		}
+		cp.base = checkCorsRules(cp.base, "CORS_POLICY")
+	}
+	return cp
+}
+
+func (cp *corsPolicies) rules(dom domain.Domain) []corsRule {
+	if dom.Cors == "" {
+		return cp.base
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	rules, ok := cp.parsed[dom.Cors]
+	if !ok {
+		if err := json.Unmarshal([]byte(dom.Cors), &rules); err != nil {
+			log.Println("bad cors of", dom.HostPublic, err)
+		}
+		rules = checkCorsRules(rules, "cors of "+dom.HostPublic)
+		if len(cp.parsed) > 1000 {
+			cp.parsed = map[string][]corsRule{}
+		}
+		cp.parsed[dom.Cors] = rules
+	}
+	return rules
+}
+
+// checkCorsRules drops * origin from rules with credentials
+func checkCorsRules(rules []corsRule, source string) []corsRule {
+	for i, rule := range rules {
+		if !rule.Credentials || !containsFold(rule.Origins, "*") {
+			continue
+		}
+		log.Println(source, rule.Path, "origin * with credentials ignored")
+		var origins []string
+		for _, o := range rule.Origins {
+			if strings.TrimSpace(o) != "*" {
+				origins = append(origins, o)
+			}
+		}
+		rules[i].Origins = origins
+	}
+	return rules
+}
+
+// rule returns the first rule for path
+func (cp *corsPolicies) rule(dom domain.Domain, path string) (corsRule, bool) {
+	for _, rule := range cp.rules(dom) {
+		if strings.HasPrefix(path, rule.Path) {
+			return rule, true
+		}
+	}
+	return corsRule{}, false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsOriginAllowed checks origin against rule origins
+func (s *Service) corsOriginAllowed(dom domain.Domain, rule corsRule, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range rule.Origins {
+		switch allowed {
+		case "*":
+			return true
+		case "$self":
+			if host == dom.HostPublic {
+				return true
+			}
+		case "$aliases":
+			if alias, err := s.domainAliasService.GetDomain(host); err == nil && alias.DomainID == dom.ID {
+				return true
+			}
+		case "$siblings":
+			if s.domainIDOf(host) != 0 {
+				return true
+			}
+		default:
+			if strings.Contains(allowed, "://") {
+				if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+					return true
+				}
+			} else if hostAllowed(host, []string{allowed}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowOriginValue is * for public rules, the origin itself when credentials are allowed
+func (rule corsRule) allowOriginValue(origin string) string {
+	if !rule.Credentials && containsFold(rule.Origins, "*") {
+		return "*"
+	}
+	return origin
+}
+
+// corsPreflight answers OPTIONS preflight for paths with a cors rule, the backend never sees it.
+// Disallowed preflights get 204 without Access-Control-Allow-* so the browser refuses the request.
+func (s *Service) corsPreflight(w http.ResponseWriter, r *http.Request, dom domain.Domain) bool {
+	method := r.Header.Get("Access-Control-Request-Method")
+	origin := r.Header.Get("Origin")
+	if r.Method != http.MethodOptions || origin == "" || method == "" {
+		return false
+	}
+	rule, ok := s.corsPolicies.rule(dom, r.URL.Path)
+	if !ok {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	h.Set("Cache-Control", "no-store")
+
+	methods := rule.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	var requested []string
+	for _, v := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			requested = append(requested, v)
+		}
+	}
+	headersOK := true
+	if !containsFold(rule.Headers, "*") {
+		for _, name := range requested {
+			if !containsFold(rule.Headers, name) {
+				headersOK = false
+			}
+		}
+	}
+
+	if !s.corsOriginAllowed(dom, rule, origin) || !containsFold(methods, method) || !headersOK {
+		log.Printf("%s (%s) %s cors preflight denied origin %s method %s headers %v\n", r.Method, dom.HostPublic, r.URL.String(), origin, method, requested)
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	h.Set("Access-Control-Allow-Origin", rule.allowOriginValue(origin))
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if rule.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if rule.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// corsHeaders replaces backend cors headers of a response on a path with a cors rule
+func (s *Service) corsHeaders(h http.Header, r *http.Request, dom domain.Domain) {
+	rule, ok := s.corsPolicies.rule(dom, r.URL.Path)
+	if !ok {
+		return
+	}
+	h.Del("Access-Control-Allow-Origin")
+	h.Del("Access-Control-Allow-Credentials")
+	h.Del("Access-Control-Expose-Headers")
+	addVary(h, "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !s.corsOriginAllowed(dom, rule, origin) {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", rule.allowOriginValue(origin))
+	if rule.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(rule.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+	}
+}
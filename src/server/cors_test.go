@@ -0,0 +1,110 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const corsTestPolicy = `[
+	{"path": "/engine/ajax/", "origins": ["*", "https://front.example.com"], "credentials": true, "headers": ["X-Requested-With"], "maxAge": 600},
+	{"path": "/api/", "origins": ["*"], "methods": ["GET"], "headers": ["*"]},
+	{"path": "/", "origins": ["$self", "*.example.org", "https://app.example.net/"]}
+]`
+
+func TestCorsStarWithCredentials(t *testing.T) {
+	rules := checkCorsRules([]corsRule{{Path: "/", Origins: []string{"*", " * ", "https://a.example.com"}, Credentials: true}}, "test")
+	if len(rules[0].Origins) != 1 || rules[0].Origins[0] != "https://a.example.com" {
+		t.Errorf("origins = %q, want only https://a.example.com", rules[0].Origins)
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	s := &Service{corsPolicies: &corsPolicies{parsed: map[string][]corsRule{}}}
+	dom := domain.Domain{HostPublic: "example.com", Cors: corsTestPolicy}
+
+	tests := []struct {
+		name        string
+		path        string
+		origin      string
+		method      string
+		headers     string
+		allowOrigin string // empty - denied
+		credentials bool
+	}{
+		{name: "star dropped with credentials", path: "/engine/ajax/x.php", origin: "https://evil.com", method: "POST"},
+		{name: "listed origin with credentials", path: "/engine/ajax/x.php", origin: "https://front.example.com", method: "POST", headers: "X-Requested-With", allowOrigin: "https://front.example.com", credentials: true},
+		{name: "header not allowed", path: "/engine/ajax/x.php", origin: "https://front.example.com", method: "POST", headers: "X-Secret"},
+		{name: "public any origin", path: "/api/list", origin: "https://evil.com", method: "GET", headers: "X-Anything", allowOrigin: "*"},
+		{name: "method not allowed", path: "/api/list", origin: "https://evil.com", method: "DELETE"},
+		{name: "self", path: "/page", origin: "https://example.com", method: "GET", allowOrigin: "https://example.com"},
+		{name: "subdomain pattern", path: "/page", origin: "https://a.example.org", method: "GET", allowOrigin: "https://a.example.org"},
+		{name: "suffix is not subdomain", path: "/page", origin: "https://evilexample.org", method: "GET"},
+		{name: "full origin", path: "/page", origin: "https://app.example.net", method: "GET", allowOrigin: "https://app.example.net"},
+		{name: "full origin other scheme", path: "/page", origin: "http://app.example.net", method: "GET"},
+		{name: "null origin", path: "/page", origin: "null", method: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				r.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			w := httptest.NewRecorder()
+			if !s.corsPreflight(w, r, dom) {
+				t.Fatal("preflight passed to the backend")
+			}
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Errorf("credentials = %v, want %v", got, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestCorsHeaders(t *testing.T) {
+	s := &Service{corsPolicies: &corsPolicies{parsed: map[string][]corsRule{}}}
+	dom := domain.Domain{HostPublic: "example.com", Cors: corsTestPolicy}
+
+	tests := []struct {
+		name        string
+		path        string
+		origin      string
+		allowOrigin string
+		credentials bool
+	}{
+		{name: "backend headers replaced for foreign origin", path: "/engine/ajax/x.php", origin: "https://evil.com"},
+		{name: "credentials", path: "/engine/ajax/x.php", origin: "https://front.example.com", allowOrigin: "https://front.example.com", credentials: true},
+		{name: "public", path: "/api/list", origin: "https://evil.com", allowOrigin: "*"},
+		{name: "no origin", path: "/api/list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			h := http.Header{}
+			h.Set("Access-Control-Allow-Origin", "*")
+			h.Set("Access-Control-Allow-Credentials", "true")
+			s.corsHeaders(h, r, dom)
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Errorf("credentials = %v, want %v", got, tt.credentials)
+			}
+			if h.Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", h.Get("Vary"))
+			}
+		})
+	}
+}
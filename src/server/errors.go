@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+)
+
+// nginx style status for requests cancelled by the client, only logged
+const statusClientClosed = 499
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body style="font-family:sans-serif;text-align:center;padding-top:10%">
+<h1>{{.Status}}</h1>
+<p>{{.StatusText}}</p>
+<p style="color:#999;font-size:small">request id: {{.RequestID}}</p>
+</body>
+</html>
+`))
+
+type errorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamStatus classifies backend errors: client gone - 499, breaker open or no upstream - 503, timeout - 504, refused/dns/reset - 502
+func upstreamStatus(r *http.Request, err error) int {
+	if r.Context().Err() != nil {
+		return statusClientClosed
+	}
+	if errors.Is(err, errBreakerOpen) || errors.Is(err, errNoUpstream) {
+		return http.StatusServiceUnavailable
+	}
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// upstreamError drops headers copied from the backend and renders error page for the classified status
+func (s *Service) upstreamError(w http.ResponseWriter, r *http.Request, domainID int, requestID string, err error) {
+	status := upstreamStatus(r, err)
+	log.Println("Proxy error", status, requestID, err)
+	if status == statusClientClosed {
+		return
+	}
+	h := w.Header()
+	for name := range h {
+		delete(h, name)
+	}
+	s.errorPage(w, domainID, status, requestID)
+}
+
+// errorPage renders flix_domain_error_pages entry for the domain or the built-in page.
+// domainID 0 - unknown domain, always built-in.
+func (s *Service) errorPage(w http.ResponseWriter, domainID int, status int, requestID string) {
+	tpl := defaultErrorPage
+	if domainID != 0 {
+		if page, err := s.errorPageService.GetPage(domainID, status); err == nil {
+			tpl = page.Template()
+		}
+	}
+
+	var buf bytes.Buffer
+	data := errorPageData{Status: status, StatusText: http.StatusText(status), RequestID: requestID}
+	if err := tpl.Execute(&buf, data); err != nil {
+		log.Println("error page", err)
+		buf.Reset()
+		defaultErrorPage.Execute(&buf, data)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"dle-proxy/database/domain"
+	"dle-proxy/database/domainAlias"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// exportSite is a domain with its alias hosts, input for traefik/nginx/caddy configs
+type exportSite struct {
+	Host    string
+	Aliases []string
+}
+
+type exportData struct {
+	Upstream string
+	Listen   string
+	Sites    []exportSite
+}
+
+var exportFuncs = template.FuncMap{"join": strings.Join}
+
+// hosts go into configs unquoted, a row with anything else would break or inject into them
+var exportHostRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// upstream, listen, traefik service and entry points
+var exportNameRe = regexp.MustCompile(`^[A-Za-z0-9@._:\[\]-]+$`)
+
+// exportSites returns all domains sorted by host, aliases sorted too
+func (s *Service) exportSites() ([]exportSite, error) {
+	domains, err := s.domainService.GetDomains()
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := s.domainAliasService.GetDomains()
+	if err != nil {
+		return nil, err
+	}
+	return exportSitesOf(domains, aliases), nil
+}
+
+// exportSitesOf groups aliases by domain, hosts that aren't plain hostnames are logged and left out
+func exportSitesOf(domains []domain.Domain, aliases []domainAlias.DomainAlias) []exportSite {
+	hosts := map[int][]string{}
+	for _, a := range aliases {
+		if !exportHostRe.MatchString(a.Host) {
+			log.Printf("export: alias host %q of domain %d skipped\n", a.Host, a.DomainID)
+			continue
+		}
+		hosts[a.DomainID] = append(hosts[a.DomainID], a.Host)
+	}
+
+	sites := make([]exportSite, 0, len(domains))
+	for _, d := range domains {
+		if !exportHostRe.MatchString(d.HostPublic) {
+			log.Printf("export: domain %d host %q skipped\n", d.ID, d.HostPublic)
+			continue
+		}
+		aliasHosts := hosts[d.ID]
+		sort.Strings(aliasHosts)
+		sites = append(sites, exportSite{Host: d.HostPublic, Aliases: aliasHosts})
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Host < sites[j].Host })
+	return sites
+}
+
+// checkExportNames rejects settings that would break the generated config
+func checkExportNames(names ...string) error {
+	for _, name := range names {
+		if !exportNameRe.MatchString(name) {
+			return fmt.Errorf("export: bad name %q", name)
+		}
+	}
+	return nil
+}
+
+// Export writes generated config of kind traefik, nginx or caddy
+func (s *Service) Export(kind string, w io.Writer) error {
+	var (
+		cfg []byte
+		err error
+	)
+	switch kind {
+	case "traefik":
+		cfg, err = s.traefikConfig()
+	case "nginx":
+		cfg, err = s.renderExport(nginxTemplate)
+	case "caddy":
+		cfg, err = s.renderExport(caddyTemplate)
+	default:
+		return fmt.Errorf("unknown export: %s", kind)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(cfg)
+	return err
+}
+
+func (s *Service) renderExport(tpl *template.Template) ([]byte, error) {
+	sites, err := s.exportSites()
+	if err != nil {
+		return nil, err
+	}
+	return renderExport(tpl, exportData{Upstream: s.exportUpstream, Listen: s.exportListen, Sites: sites})
+}
+
+func renderExport(tpl *template.Template, data exportData) ([]byte, error) {
+	if err := checkExportNames(data.Upstream, data.Listen); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Service) exportHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := s.Export(kind, &buf); err != nil {
+			log.Println(kind, "config", err)
+			http.Error(w, "Error building "+kind+" config", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
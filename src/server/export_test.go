@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"dle-proxy/database/domain"
+	"dle-proxy/database/domainAlias"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden")
+
+var exportTestSites = []exportSite{
+	{Host: "alpha.example.com", Aliases: []string{"alpha.example.net", "www.alpha.example.com"}},
+	{Host: "beta.example.org"},
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch, run go test -update\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestRenderTraefik(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings traefikSettings
+		sites    []exportSite
+	}{
+		{"traefik", traefikSettings{service: "cis-proxy@docker"}, exportTestSites},
+		{"traefik_tls", traefikSettings{service: "cis-proxy@docker", entryPoints: []string{"websecure"}, certResolver: "le"}, exportTestSites},
+		{"traefik_empty", traefikSettings{service: "cis-proxy@docker"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTraefik(tt.settings, tt.sites)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+}
+
+func TestRenderNginx(t *testing.T) {
+	tests := []struct {
+		name string
+		data exportData
+	}{
+		{"nginx", exportData{Upstream: "dle-proxy:8090", Listen: "80", Sites: exportTestSites}},
+		{"nginx_empty", exportData{Upstream: "dle-proxy:8090", Listen: "80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderExport(nginxTemplate, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+}
+
+func TestRenderCaddy(t *testing.T) {
+	tests := []struct {
+		name string
+		data exportData
+	}{
+		{"caddy", exportData{Upstream: "dle-proxy:8090", Listen: "80", Sites: exportTestSites}},
+		{"caddy_empty", exportData{Upstream: "dle-proxy:8090", Listen: "80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderExport(caddyTemplate, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.name, got)
+		})
+	}
+}
+
+func TestExportSitesOf(t *testing.T) {
+	domains := []domain.Domain{
+		{ID: 1, HostPublic: "beta.example.org"},
+		{ID: 2, HostPublic: "alpha.example.com"},
+		{ID: 3, HostPublic: "evil.example.com; return 200"},
+		{ID: 4, HostPublic: "bad}.example.com"},
+	}
+	aliases := []domainAlias.DomainAlias{
+		{DomainID: 2, Host: "www.alpha.example.com"},
+		{DomainID: 2, Host: "alpha.example.net"},
+		{DomainID: 2, Host: "x.example.com\n    location /"},
+		{DomainID: 1, Host: "-bad.example.org"},
+	}
+	want := exportTestSites
+	if got := exportSitesOf(domains, aliases); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExportNames(t *testing.T) {
+	tests := []struct {
+		name string
+		err  bool
+	}{
+		{"dle-proxy:8090", false},
+		{"[::1]:8090", false},
+		{"cis-proxy@docker", false},
+		{"", true},
+		{"dle-proxy:8090; }", true},
+		{"a b", true},
+	}
+	for _, tt := range tests {
+		if err := checkExportNames(tt.name); (err != nil) != tt.err {
+			t.Errorf("%q: %v", tt.name, err)
+		}
+	}
+	if _, err := renderExport(nginxTemplate, exportData{Upstream: "x; }", Listen: "80"}); err == nil {
+		t.Error("bad upstream rendered")
+	}
+	if _, err := renderTraefik(traefikSettings{service: "a`b"}, exportTestSites); err == nil {
+		t.Error("bad traefik service rendered")
+	}
+}
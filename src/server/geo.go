@@ -0,0 +1,63 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// GeoIP2/GeoLite2 Country or City record
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// clientCountry is CF-IPCountry from cloudflare, otherwise GEOIP_DB lookup. "" - unknown.
+func (s *Service) clientCountry(r *http.Request, c client) string {
+	if c.cloudflare {
+		if cf := strings.ToUpper(strings.TrimSpace(r.Header.Get("Cf-Ipcountry"))); len(cf) == 2 && cf != "XX" {
+			return cf
+		}
+	}
+	var rec countryRecord
+	if err := s.geoDB.lookup(c.ip, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+// geoRule applies flix_domain_geo: 451 for blocked countries, redirect to another domain or nothing
+func (s *Service) geoRule(w http.ResponseWriter, r *http.Request, dom domain.Domain, country, requestID string) bool {
+	if s.geoService == nil {
+		return false
+	}
+	rule, err := s.geoService.GetRule(dom.ID, country)
+	if err != nil {
+		return false
+	}
+
+	switch rule.Action {
+	case "block":
+		log.Printf("%s (%s) %s 451 country %s\n", r.Method, dom.HostPublic, r.URL.String(), country)
+		s.metrics.inc("dle_proxy_geo_total", "domain", dom.HostPublic, "action", rule.Action)
+		s.errorPage(w, dom.ID, http.StatusUnavailableForLegalReasons, requestID)
+		return true
+	case "redirect":
+		target, err := s.domainService.GetDomainByID(rule.TargetDomainId)
+		if err != nil || target.ID == dom.ID {
+			log.Println("geo rule", rule.ID, "bad target domain", rule.TargetDomainId, err)
+			return false
+		}
+		targetURL := fmt.Sprintf("https://%s%s", target.HostPublic, r.URL.String())
+		log.Printf("%s (%s) %s 302 %s country %s\n", r.Method, dom.HostPublic, r.URL.String(), targetURL, country)
+		s.metrics.inc("dle_proxy_geo_total", "domain", dom.HostPublic, "action", rule.Action)
+		// depends on the client country, must not be cached
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, targetURL, http.StatusFound)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// headerPolicy is flix_domain.header_policy json, HEADER_POLICY is the default it's merged over.
+// Empty fields inherit, "off" removes the header. Routes override the policy per route kind:
+//
+//	{"hsts": {"maxAge": 31536000, "includeSubdomains": true, "preload": true},
+//	 "csp": "default-src 'self'", "cspReportOnly": true, "frameOptions": "SAMEORIGIN",
+//	 "referrerPolicy": "strict-origin-when-cross-origin", "permissionsPolicy": "camera=()",
+//	 "contentTypeOptions": "nosniff", "set": {"X-Robots-Tag": "noarchive"}, "remove": ["X-Dle-Version"],
+//	 "routes": {"imager": {"csp": "off"}}}
+type headerPolicy struct {
+	HSTS               *hstsPolicy             `json:"hsts,omitempty"`
+	CSP                string                  `json:"csp,omitempty"`
+	CSPReportOnly      *bool                   `json:"cspReportOnly,omitempty"`
+	FrameOptions       string                  `json:"frameOptions,omitempty"`
+	ReferrerPolicy     string                  `json:"referrerPolicy,omitempty"`
+	PermissionsPolicy  string                  `json:"permissionsPolicy,omitempty"`
+	ContentTypeOptions string                  `json:"contentTypeOptions,omitempty"`
+	Set                map[string]string       `json:"set,omitempty"`
+	Remove             []string                `json:"remove,omitempty"`
+	Routes             map[string]headerPolicy `json:"routes,omitempty"`
+}
+
+// hstsPolicy with MaxAge 0 removes Strict-Transport-Security
+type hstsPolicy struct {
+	MaxAge            int  `json:"maxAge"`
+	IncludeSubdomains bool `json:"includeSubdomains"`
+	Preload           bool `json:"preload"`
+}
+
+// merge returns p with non-empty fields of o on top
+func (p headerPolicy) merge(o headerPolicy) headerPolicy {
+	if o.HSTS != nil {
+		p.HSTS = o.HSTS
+	}
+	if o.CSP != "" {
+		p.CSP = o.CSP
+	}
+	if o.CSPReportOnly != nil {
+		p.CSPReportOnly = o.CSPReportOnly
+	}
+	if o.FrameOptions != "" {
+		p.FrameOptions = o.FrameOptions
+	}
+	if o.ReferrerPolicy != "" {
+		p.ReferrerPolicy = o.ReferrerPolicy
+	}
+	if o.PermissionsPolicy != "" {
+		p.PermissionsPolicy = o.PermissionsPolicy
+	}
+	if o.ContentTypeOptions != "" {
+		p.ContentTypeOptions = o.ContentTypeOptions
+	}
+	if len(o.Set) > 0 {
+		set := map[string]string{}
+		for name, v := range p.Set {
+			set[name] = v
+		}
+		for name, v := range o.Set {
+			set[name] = v
+		}
+		p.Set = set
+	}
+	p.Remove = append(append([]string{}, p.Remove...), o.Remove...)
+	if len(o.Routes) > 0 {
+		routes := map[string]headerPolicy{}
+		for kind, r := range p.Routes {
+			routes[kind] = r
+		}
+		for kind, r := range o.Routes {
+			routes[kind] = routes[kind].merge(r)
+		}
+		p.Routes = routes
+	}
+	return p
+}
+
+// headerPolicies caches parsed policies by their json
+type headerPolicies struct {
+	base   headerPolicy
+	mu     sync.Mutex
+	parsed map[string]headerPolicy
+}
+
+func newHeaderPolicies() *headerPolicies {
+	hp := &headerPolicies{parsed: map[string]headerPolicy{}}
+	if v := envString("HEADER_POLICY", ""); v != "" {
+		if err := json.Unmarshal([]byte(v), &hp.base); err != nil {
+			log.Println("bad HEADER_POLICY", err)
+		}
+	}
+	return hp
+}
+
+// policy returns HEADER_POLICY merged with the domain policy and its route override
+func (hp *headerPolicies) policy(dom domain.Domain, kind string) headerPolicy {
+	hp.mu.Lock()
+	p, ok := hp.parsed[dom.HeaderPolicy]
+	if !ok {
+		p = hp.base
+		if dom.HeaderPolicy != "" {
+			var own headerPolicy
+			if err := json.Unmarshal([]byte(dom.HeaderPolicy), &own); err != nil {
+				log.Println("bad header_policy of", dom.HostPublic, err)
+			} else {
+				p = p.merge(own)
+			}
+		}
+		// policies change rarely, forget them all instead of tracking which are gone
+		if len(hp.parsed) > 1000 {
+			hp.parsed = map[string]headerPolicy{}
+		}
+		hp.parsed[dom.HeaderPolicy] = p
+	}
+	hp.mu.Unlock()
+
+	if route, ok := p.Routes[kind]; ok {
+		p = p.merge(route)
+	}
+	return p
+}
+
+func setOrRemove(h http.Header, name, value string) {
+	switch value {
+	case "":
+	case "off":
+		h.Del(name)
+	default:
+		h.Set(name, value)
+	}
+}
+
+// apply sets the policy headers on a response, HSTS only over https
+func (p headerPolicy) apply(h http.Header, https bool) {
+	for _, name := range p.Remove {
+		h.Del(name)
+	}
+
+	if p.HSTS != nil {
+		h.Del("Strict-Transport-Security")
+		if https && p.HSTS.MaxAge > 0 {
+			v := fmt.Sprintf("max-age=%d", p.HSTS.MaxAge)
+			if p.HSTS.IncludeSubdomains {
+				v += "; includeSubDomains"
+			}
+			if p.HSTS.Preload {
+				v += "; preload"
+			}
+			h.Set("Strict-Transport-Security", v)
+		}
+	}
+
+	if p.CSP != "" {
+		h.Del("Content-Security-Policy")
+		h.Del("Content-Security-Policy-Report-Only")
+		if p.CSP != "off" {
+			name := "Content-Security-Policy"
+			if p.CSPReportOnly != nil && *p.CSPReportOnly {
+				name = "Content-Security-Policy-Report-Only"
+			}
+			h.Set(name, p.CSP)
+		}
+	}
+
+	setOrRemove(h, "X-Frame-Options", p.FrameOptions)
+	setOrRemove(h, "Referrer-Policy", p.ReferrerPolicy)
+	setOrRemove(h, "Permissions-Policy", p.PermissionsPolicy)
+	setOrRemove(h, "X-Content-Type-Options", p.ContentTypeOptions)
+	for name, v := range p.Set {
+		setOrRemove(h, name, strings.TrimSpace(v))
+	}
+}
+
+// policyWriter applies the header policy to every response Proxy writes: proxied, error pages,
+// challenge, hotlink, login, stale and 101. Proxy fills in domain and route kind as it learns them,
+// before the domain is known HEADER_POLICY alone applies.
+type policyWriter struct {
+	http.ResponseWriter
+	policies *headerPolicies
+	dom      domain.Domain
+	kind     string
+	https    bool
+	applied  bool
+}
+
+func (w *policyWriter) applyPolicy(h http.Header) {
+	w.policies.policy(w.dom, w.kind).apply(h, w.https)
+}
+
+func (w *policyWriter) WriteHeader(code int) {
+	if !w.applied && code >= http.StatusOK {
+		w.applied = true
+		w.applyPolicy(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *policyWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack
+func (w *policyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// applyHeaderPolicy is for responses written past the ResponseWriter, like 101 on a hijacked connection
+func applyHeaderPolicy(w http.ResponseWriter, h http.Header) {
+	if pw, ok := w.(*policyWriter); ok {
+		pw.applyPolicy(h)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// 1x1 transparent gif, HOTLINK_PLACEHOLDER replaces it with a file
+var transparentGIF, _ = base64.StdEncoding.DecodeString("R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7")
+
+type placeholderImage struct {
+	contentType string
+	body        []byte
+}
+
+func loadPlaceholder() placeholderImage {
+	name := envString("HOTLINK_PLACEHOLDER", "")
+	if name == "" {
+		return placeholderImage{"image/gif", transparentGIF}
+	}
+	body, err := os.ReadFile(name)
+	if err != nil {
+		log.Println("hotlink placeholder", err)
+		return placeholderImage{"image/gif", transparentGIF}
+	}
+	return placeholderImage{http.DetectContentType(body), body}
+}
+
+// hostAllowed matches host against a comma separated list, *.example.com matches subdomains
+func hostAllowed(host string, list []string) bool {
+	for _, pattern := range list {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// refererAllowed lets through the domain itself, its aliases, flix_domain.hotlink_allow and HOTLINK_ALLOW.
+// Empty referer is allowed unless flix_domain.hotlink_block_empty.
+func (s *Service) refererAllowed(dom domain.Domain, referer string) bool {
+	if referer == "" {
+		return !dom.HotlinkBlockEmpty
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == dom.HostPublic {
+		return true
+	}
+	if alias, err := s.domainAliasService.GetDomain(host); err == nil && alias.DomainID == dom.ID {
+		return true
+	}
+	return hostAllowed(host, strings.Split(dom.HotlinkAllow, ",")) || hostAllowed(host, s.hotlinkAllow)
+}
+
+// hotlinked answers image requests from foreign referers according to flix_domain.hotlink_mode:
+// 403, placeholder or redirect (to hotlink_redirect or the domain home page). Empty mode - off.
+func (s *Service) hotlinked(w http.ResponseWriter, r *http.Request, dom domain.Domain, requestID string) bool {
+	if dom.HotlinkMode == "" || s.refererAllowed(dom, r.Referer()) {
+		return false
+	}
+
+	log.Printf("%s (%s) %s hotlink %s %q\n", r.Method, dom.HostPublic, r.URL.String(), dom.HotlinkMode, r.Referer())
+	s.metrics.inc("dle_proxy_hotlink_blocked_total", "domain", dom.HostPublic, "mode", dom.HotlinkMode)
+	// depends on Referer, must not be cached for other sites
+	w.Header().Set("Cache-Control", "private, no-store")
+	switch dom.HotlinkMode {
+	case "placeholder":
+		w.Header().Set("Content-Type", s.hotlinkPlaceholder.contentType)
+		w.Write(s.hotlinkPlaceholder.body)
+	case "redirect":
+		target := dom.HotlinkRedirect
+		if target == "" {
+			target = "https://" + dom.HostPublic + "/"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	default:
+		s.errorPage(w, dom.ID, http.StatusForbidden, requestID)
+	}
+	return true
+}
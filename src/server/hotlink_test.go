@@ -0,0 +1,84 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"dle-proxy/database/domainAlias"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	list := []string{" Partner.com ", "*.example.org"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "partner.com", want: true},
+		{host: "www.partner.com", want: false},
+		{host: "a.example.org", want: true},
+		{host: "a.b.example.org", want: true},
+		{host: "example.org", want: false},
+		{host: "evilexample.org", want: false},
+		{host: "example.org.evil.com", want: false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host, list); got != tt.want {
+			t.Errorf("hostAllowed(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHotlinked(t *testing.T) {
+	s := &Service{
+		metrics:            newMetricSet(),
+		domainAliasService: &domainAlias.Service{},
+		hotlinkAllow:       []string{"*.google.com"},
+		hotlinkPlaceholder: placeholderImage{"image/gif", transparentGIF},
+	}
+
+	tests := []struct {
+		name     string
+		dom      domain.Domain
+		referer  string
+		status   int // 0 - passed through
+		location string
+	}{
+		{name: "off", dom: domain.Domain{}, referer: "https://evil.com/"},
+		{name: "own page", dom: domain.Domain{HotlinkMode: "403"}, referer: "https://example.com/news/1.html"},
+		{name: "own host other port", dom: domain.Domain{HotlinkMode: "403"}, referer: "https://example.com:8443/"},
+		{name: "foreign", dom: domain.Domain{HotlinkMode: "403"}, referer: "https://evil.com/", status: http.StatusForbidden},
+		{name: "own host as subdomain of foreign", dom: domain.Domain{HotlinkMode: "403"}, referer: "https://example.com.evil.com/", status: http.StatusForbidden},
+		{name: "domain allow list", dom: domain.Domain{HotlinkMode: "403", HotlinkAllow: "partner.com, *.friends.net"}, referer: "https://cdn.friends.net/"},
+		{name: "global allow list", dom: domain.Domain{HotlinkMode: "403"}, referer: "https://images.google.com/"},
+		{name: "empty referer", dom: domain.Domain{HotlinkMode: "403"}},
+		{name: "empty referer blocked", dom: domain.Domain{HotlinkMode: "403", HotlinkBlockEmpty: true}, status: http.StatusForbidden},
+		{name: "garbage referer", dom: domain.Domain{HotlinkMode: "403"}, referer: "not a url", status: http.StatusForbidden},
+		{name: "placeholder", dom: domain.Domain{HotlinkMode: "placeholder"}, referer: "https://evil.com/", status: http.StatusOK},
+		{name: "redirect home", dom: domain.Domain{HotlinkMode: "redirect"}, referer: "https://evil.com/", status: http.StatusFound, location: "https://example.com/"},
+		{name: "redirect target", dom: domain.Domain{HotlinkMode: "redirect", HotlinkRedirect: "https://example.com/hotlink.html"}, referer: "https://evil.com/", status: http.StatusFound, location: "https://example.com/hotlink.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dom := tt.dom
+			dom.HostPublic = "example.com"
+			r := httptest.NewRequest(http.MethodGet, "/posts/2024/a.jpg", nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			w := httptest.NewRecorder()
+			got := s.hotlinked(w, r, dom, "req")
+			if got != (tt.status != 0) || (got && w.Code != tt.status) {
+				t.Fatalf("hotlinked = %v status %d, want status %d", got, w.Code, tt.status)
+			}
+			// depends on Referer, must not be cached for other sites
+			if got && !strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+				t.Errorf("Cache-Control = %q", w.Header().Get("Cache-Control"))
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
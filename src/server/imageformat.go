@@ -0,0 +1,77 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// source images we can convert on the fly
+var convertibleImages = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// negotiateImageFormat returns the first of domain ImageFormats explicitly accepted by the client.
+// Wildcards don't count: old browsers send */* and can't decode webp.
+func negotiateImageFormat(dom domain.Domain, accept string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		if q > 0 {
+			accepted[mediaType] = true
+		}
+	}
+
+	for _, format := range strings.Split(dom.ImageFormats, ",") {
+		format = strings.TrimSpace(format)
+		if format != "" && accepted["image/"+format] {
+			return format
+		}
+	}
+	return ""
+}
+
+// firstURL returns first url of a comma separated service field
+func firstURL(service string) string {
+	if urls := serviceURLs(service); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// imagerConvertURI returns imaginary uri converting imager file to format
+func imagerConvertURI(dom domain.Domain, uri, format string) string {
+	q := url.Values{}
+	q.Set("type", format)
+	q.Set("url", firstURL(dom.ServiceImager)+uri)
+	return "/convert?" + q.Encode()
+}
+
+func isConvertibleImage(path string) bool {
+	return convertibleImages[strings.ToLower(filepath.Ext(path))]
+}
+
+// addVary appends value to Vary header unless it's already there
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if token == "*" || strings.EqualFold(token, value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
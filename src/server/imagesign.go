@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"dle-proxy/database/domain"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// files imaginary may read from its mount with file=
+var imageFileExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".gif": true, ".avif": true}
+
+// SignImageURL adds signature (s) and optional expiry (e) params to a /resize/ or /crop/ uri.
+// Zero expires means the url never expires.
+func SignImageURL(secret, uri string, expires time.Time) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	query, err := imageQuery(u)
+	if err != nil {
+		return "", err
+	}
+	delete(query, "s")
+	delete(query, "e")
+	if !expires.IsZero() {
+		query["e"] = strconv.FormatInt(expires.Unix(), 10)
+	}
+	query["s"] = imageSignature(secret, u.Path, query)
+
+	q := url.Values{}
+	for name, value := range query {
+		q.Set(name, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// imageSignedQuery is the signed form of the query: params but s sorted by name, name=value escaped
+// like php rawurlencode (RFC 3986) and joined by &. php gets the same string from
+// http_build_query with PHP_QUERY_RFC3986 after ksort, whatever encoding the url itself uses.
+func imageSignedQuery(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != "s" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = rawURLEncode(name) + "=" + rawURLEncode(query[name])
+	}
+	return strings.Join(pairs, "&")
+}
+
+// rawURLEncode escapes everything but unreserved characters, as php rawurlencode does
+func rawURLEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
+
+// signature covers path and the signed query
+func imageSignature(secret, path string, query map[string]string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "?" + imageSignedQuery(query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyImageSignature(secret string, u *url.URL) error {
+	query, err := imageQuery(u)
+	if err != nil {
+		return err
+	}
+	sig := query["s"]
+	if sig == "" {
+		return fmt.Errorf("unsigned url")
+	}
+	if !hmac.Equal([]byte(sig), []byte(imageSignature(secret, u.Path, query))) {
+		return fmt.Errorf("bad signature")
+	}
+	if e := query["e"]; e != "" {
+		expires, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			return fmt.Errorf("url expired")
+		}
+	}
+	return nil
+}
+
+// checkImageURL allows only signed urls (when domain has ResizeSecret) pointing to whitelisted source hosts
+// or to image files of the imaginary mount.
+func checkImageURL(dom domain.Domain, u *url.URL) error {
+	query, err := imageQuery(u)
+	if err != nil {
+		return err
+	}
+	if dom.ResizeSecret != "" {
+		if err := verifyImageSignature(dom.ResizeSecret, u); err != nil {
+			return err
+		}
+	}
+
+	if file, ok := query["file"]; ok {
+		if _, ok := query["url"]; ok {
+			return fmt.Errorf("url and file together")
+		}
+		return checkImageFile(file)
+	}
+	src := query["url"]
+	if src == "" {
+		return fmt.Errorf("url is required")
+	}
+	srcURL, err := url.Parse(src)
+	if err != nil || srcURL.Hostname() == "" || (srcURL.Scheme != "http" && srcURL.Scheme != "https") {
+		return fmt.Errorf("bad source url")
+	}
+	if !imageSourceAllowed(dom, srcURL.Hostname()) {
+		return fmt.Errorf("source host not allowed: %s", srcURL.Hostname())
+	}
+	return nil
+}
+
+// checkImageFile allows relative paths to image files inside the imaginary mount
+func checkImageFile(file string) error {
+	if file == "" || strings.HasPrefix(file, "/") || strings.Contains(file, "\\") || path.Clean(file) != file || strings.HasPrefix(file, "..") {
+		return fmt.Errorf("bad file: %s", file)
+	}
+	if !imageFileExts[strings.ToLower(path.Ext(file))] {
+		return fmt.Errorf("not an image file: %s", file)
+	}
+	return nil
+}
+
+func imageSourceAllowed(dom domain.Domain, host string) bool {
+	for _, u := range serviceURLs(dom.ServiceImager) {
+		if imager, err := url.Parse(u); err == nil && imager.Hostname() == host {
+			return true
+		}
+	}
+	for _, h := range strings.Split(dom.ResizeHosts, ",") {
+		if strings.TrimSpace(h) == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageSignedQuery(t *testing.T) {
+	// what php http_build_query($q, '', '&', PHP_QUERY_RFC3986) gives after ksort
+	query := map[string]string{"w": "100", "url": "https://imager/~a b.jpg", "e": "4102444800", "s": "ignored"}
+	want := "e=4102444800&url=https%3A%2F%2Fimager%2F~a%20b.jpg&w=100"
+	if got := imageSignedQuery(query); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestVerifyImageSignature(t *testing.T) {
+	const secret = "secret"
+	signed, err := SignImageURL(secret, "/resize/?w=100&url=https://imager/~a%20b.jpg", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := SignImageURL(secret, "/resize/?w=100&url=https://imager/a.jpg", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forever, err := SignImageURL(secret, "/crop/?w=10&h=10&url=https://imager/a.jpg", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		uri  string
+		err  string
+	}{
+		{"valid", signed, ""},
+		{"no expiry", forever, ""},
+		// signature made by php with PHP_QUERY_RFC3986, url encoded by http_build_query default (RFC 1738)
+		{"php", "/resize/?e=4102444800&url=https%3A%2F%2Fimager%2F%7Ea+b.jpg&w=100&s=7z3zP9tib75_dmj5LGBEUVY9zMVjLRQxkirrKxs1rjo", ""},
+		{"tampered value", strings.Replace(signed, "w=100", "w=200", 1), "bad signature"},
+		{"tampered path", strings.Replace(signed, "/resize/", "/crop/", 1), "bad signature"},
+		{"added param", signed + "&q=10", "bad signature"},
+		{"wrong secret", strings.Replace(forever, "s=", "s=x", 1), "bad signature"},
+		{"expired", expired, "url expired"},
+		{"repeated param", signed + "&w=300", "repeated parameter"},
+		{"unsigned", "/resize/?w=100&url=https://imager/a.jpg", "unsigned url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifyImageSignature(secret, u)
+			if tt.err == "" && err != nil {
+				t.Fatalf("%s: %v", tt.uri, err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("%s: got %v, want %s", tt.uri, err, tt.err)
+			}
+		})
+	}
+}
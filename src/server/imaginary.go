@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const imaginaryHost = "http://imaginary:8088"
+
+// biggest width/height we ask imaginary to render
+const imageMaxSize = 4096
+
+type imagePreset struct {
+	width   int
+	height  int
+	quality int
+	fit     string
+	format  string
+}
+
+// named sizes for templates: /resize/poster-sm/?url=...
+var imagePresets = map[string]imagePreset{
+	"poster-sm": {width: 200, height: 300, fit: "cover"},
+	"poster-md": {width: 300, height: 450, fit: "cover"},
+	"poster-lg": {width: 600, height: 900, fit: "cover"},
+	"thumb":     {width: 320, height: 180, fit: "cover"},
+}
+
+// public fit value -> imaginary operation
+var imageFits = map[string]string{
+	"cover":   "crop",
+	"contain": "fit",
+	"fill":    "resize",
+	"inside":  "resize",
+	"smart":   "smartcrop",
+}
+
+var imageFormats = map[string]string{
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"avif": "avif",
+}
+
+// imaginaryURI translates public /resize/ and /crop/ urls to imaginary api:
+//
+//	/resize/[preset/]?w=&h=&q=&fit=&fmt=&url=  ->  /<operation>?width=&height=&quality=&type=&url=
+//
+// autoFormat is used when the url has no fmt, auto reports whether that happened (response varies by Accept).
+func imaginaryURI(u *url.URL, autoFormat string) (uri string, auto bool, err error) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	op := parts[0]
+	if op != "resize" && op != "crop" {
+		return "", false, fmt.Errorf("unknown operation: %s", op)
+	}
+	if len(parts) > 2 {
+		return "", false, fmt.Errorf("bad image path: %s", u.Path)
+	}
+
+	var p imagePreset
+	if len(parts) == 2 {
+		preset, ok := imagePresets[parts[1]]
+		if !ok {
+			return "", false, fmt.Errorf("unknown preset: %s", parts[1])
+		}
+		p = preset
+	}
+
+	query, err := imageQuery(u)
+	if err != nil {
+		return "", false, err
+	}
+
+	out := url.Values{}
+	for name, value := range query {
+		switch name {
+		case "w", "width":
+			p.width, err = imageParam(name, value, 1, imageMaxSize)
+		case "h", "height":
+			p.height, err = imageParam(name, value, 1, imageMaxSize)
+		case "q":
+			p.quality, err = imageParam(name, value, 1, 100)
+		case "fit":
+			p.fit = value
+		case "fmt":
+			p.format = value
+		case "url", "file":
+			out.Set(name, value)
+		case "s", "e":
+			// signature, checked by checkImageURL
+		default:
+			err = fmt.Errorf("unknown parameter: %s", name)
+		}
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	if out.Get("url") == "" && out.Get("file") == "" {
+		return "", false, fmt.Errorf("url is required")
+	}
+	if p.width == 0 && p.height == 0 {
+		return "", false, fmt.Errorf("w or h is required")
+	}
+
+	if p.fit != "" {
+		fitOp, ok := imageFits[p.fit]
+		if !ok {
+			return "", false, fmt.Errorf("unknown fit: %s", p.fit)
+		}
+		op = fitOp
+		if p.fit == "fill" {
+			out.Set("force", "true")
+		}
+	}
+	if op == "fit" && (p.width == 0 || p.height == 0) {
+		return "", false, fmt.Errorf("fit=%s needs both w and h", p.fit)
+	}
+
+	if p.format == "" {
+		p.format = autoFormat
+		auto = true
+	}
+	if p.format != "" {
+		format, ok := imageFormats[p.format]
+		if !ok {
+			return "", false, fmt.Errorf("unknown fmt: %s", p.format)
+		}
+		out.Set("type", format)
+	}
+	if p.width > 0 {
+		out.Set("width", strconv.Itoa(p.width))
+	}
+	if p.height > 0 {
+		out.Set("height", strconv.Itoa(p.height))
+	}
+	if p.quality > 0 {
+		out.Set("quality", strconv.Itoa(p.quality))
+	}
+
+	return "/" + op + "?" + out.Encode(), auto, nil
+}
+
+// imageQuery returns query params of an image url, repeated params are rejected
+// so the value checked by checkImageURL is the one imaginary gets
+func imageQuery(u *url.URL) (map[string]string, error) {
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("bad query: %w", err)
+	}
+	query := map[string]string{}
+	for name, v := range values {
+		if len(v) != 1 {
+			return nil, fmt.Errorf("repeated parameter: %s", name)
+		}
+		query[name] = v[0]
+	}
+	return query, nil
+}
+
+func imageParam(name, value string, min, max int) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("bad %s: must be %d..%d", name, min, max)
+	}
+	return v, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listeners passed to a new process on handoff: DLE_PROXY_LISTENERS=http,https, fds start at 3
+const inheritEnv = "DLE_PROXY_LISTENERS"
+
+// fd of a pipe the new process writes to once it serves, the old one waits for it before stopping
+const readyEnv = "DLE_PROXY_READY_FD"
+
+// listen returns listener inherited from the parent process or opens a new one.
+// REUSEPORT=1 sets SO_REUSEPORT so a new binary can bind the same port while the old one drains.
+func (s *Service) listen(name, addr string) (net.Listener, error) {
+	for i, inherited := range strings.Split(os.Getenv(inheritEnv), ",") {
+		if inherited != name {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+		log.Println("using inherited listener", name, ln.Addr())
+		return ln, nil
+	}
+
+	lc := net.ListenConfig{}
+	if s.reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// Handoff starts a copy of the current binary passing it our listening sockets and waits until it
+// serves them, up to HANDOFF_TIMEOUT. After it returns nil the caller should shut down gracefully,
+// the child keeps accepting. A child that exits or doesn't get ready in time is killed, we keep serving.
+func (s *Service) Handoff() error {
+	var (
+		names []string
+		files []*os.File
+	)
+	s.mu.Lock()
+	for _, name := range []string{"http", "https"} {
+		ln, ok := s.listeners[name].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := ln.File()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		defer f.Close()
+		names = append(names, name)
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+	if len(files) == 0 {
+		return fmt.Errorf("no listeners to hand off")
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		inheritEnv+"="+strings.Join(names, ","),
+		readyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	// the child has its copy, ours must be closed for the read to see the child exit
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	log.Println("handoff to pid", cmd.Process.Pid, names)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	got := make(chan bool, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		got <- n == 1
+	}()
+
+	select {
+	case ok := <-got:
+		if ok {
+			log.Println("handoff: pid", cmd.Process.Pid, "is serving")
+			return nil
+		}
+		err = fmt.Errorf("pid %d closed readiness pipe without serving", cmd.Process.Pid)
+	case err = <-exited:
+		err = fmt.Errorf("pid %d exited: %v", cmd.Process.Pid, err)
+	case <-time.After(s.handoffTimeout):
+		err = fmt.Errorf("pid %d not ready after %s", cmd.Process.Pid, s.handoffTimeout)
+	}
+	cmd.Process.Kill()
+	return err
+}
+
+// notifyReady tells the parent that handed us the listeners that we serve them
+func notifyReady() {
+	v := os.Getenv(readyEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Println("bad", readyEnv, v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Println("handoff ready", err)
+	}
+	f.Close()
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHandoff runs the test binary itself as the new process: with DLE_PROXY_LISTENERS set it plays the child
+func TestHandoff(t *testing.T) {
+	if os.Getenv(inheritEnv) != "" {
+		if os.Getenv("HANDOFF_TEST_CHILD") == "fail" {
+			os.Exit(1)
+		}
+		s := &Service{}
+		ln, err := s.listen("http", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		notifyReady()
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &Service{listeners: map[string]net.Listener{"http": ln}, handoffTimeout: 10 * time.Second}
+
+	tests := []struct {
+		child string
+		err   string
+	}{
+		{"ok", ""},
+		{"fail", "pid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.child, func(t *testing.T) {
+			t.Setenv("HANDOFF_TEST_CHILD", tt.child)
+			err := s.Handoff()
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricSet is a tiny prometheus text exposition registry, enough for counters and gauges
+type metricSet struct {
+	mu     sync.Mutex
+	values map[string]float64 // name{labels} -> value
+	types  map[string]string
+	help   map[string]string
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		values: map[string]float64{},
+		types:  map[string]string{},
+		help:   map[string]string{},
+	}
+}
+
+func (m *metricSet) describe(name, kind, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.types[name] = kind
+	m.help[name] = help
+}
+
+// add increments counter name with label pairs: add("x_total", 1, "backend", "dle")
+func (m *metricSet) add(name string, v float64, labels ...string) {
+	key := metricKey(name, labels)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metricSet) inc(name string, labels ...string) {
+	m.add(name, 1, labels...)
+}
+
+func (m *metricSet) set(name string, v float64, labels ...string) {
+	key := metricKey(name, labels)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func metricKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricSet) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	described := map[string]bool{}
+	for _, k := range keys {
+		name, _, _ := strings.Cut(k, "{")
+		if !described[name] {
+			described[name] = true
+			if help := m.help[name]; help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+			}
+			if kind := m.types[name]; kind != "" {
+				fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+			}
+		}
+		fmt.Fprintf(w, "%s %g\n", k, m.values[k])
+	}
+}
+
+func (s *Service) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.updateBreakerMetrics()
+	for _, u := range s.upstreamStatuses() {
+		healthy := 0.0
+		if u.Healthy {
+			healthy = 1
+		}
+		s.metrics.set("dle_proxy_upstream_healthy", healthy, "backend", u.Backend, "upstream", u.URL)
+		s.metrics.set("dle_proxy_upstream_active", float64(u.Active), "backend", u.Backend, "upstream", u.URL)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w)
+}
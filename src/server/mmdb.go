@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbFile is a MaxMind format database, read again when the file mtime changes
+type mmdbFile struct {
+	path   string
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+	mtime  time.Time
+}
+
+// newMMDBFile loads path and checks it for changes every MMDB_RELOAD_PERIOD
+func newMMDBFile(ctx context.Context, path string) *mmdbFile {
+	f := &mmdbFile{path: path}
+	if err := f.reload(); err != nil {
+		log.Println("mmdb", err)
+	}
+	go f.reloadWorker(ctx, envDuration("MMDB_RELOAD_PERIOD", time.Minute))
+	return f
+}
+
+func (f *mmdbFile) reloadWorker(ctx context.Context, period time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+		if err := f.reload(); err != nil {
+			log.Println("mmdb", err)
+		}
+	}
+}
+
+// reload reads the whole file into memory, so it may be overwritten in place
+func (f *mmdbFile) reload() error {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	same := st.ModTime().Equal(f.mtime)
+	f.mu.RUnlock()
+	if same {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.mu.Lock()
+	f.reader = reader
+	f.mtime = st.ModTime()
+	f.mu.Unlock()
+	log.Println("mmdb loaded", f.path, reader.Metadata.DatabaseType, time.Unix(int64(reader.Metadata.BuildEpoch), 0).Format(time.DateOnly))
+	return nil
+}
+
+// lookup decodes the record for addr into result, nil f is an empty database
+func (f *mmdbFile) lookup(addr netip.Addr, result any) error {
+	if f == nil {
+		return fmt.Errorf("mmdb not configured")
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.reader == nil {
+		return fmt.Errorf("mmdb %s not loaded", f.path)
+	}
+	return f.reader.Lookup(net.IP(addr.Unmap().AsSlice()), result)
+}
@@ -0,0 +1,39 @@
+package server
+
+import "text/template"
+
+var nginxTemplate = template.Must(template.New("nginx").Funcs(exportFuncs).Parse(`# generated by dle-proxy, do not edit
+
+map $http_upgrade $dle_proxy_connection {
+    default upgrade;
+    ''      '';
+}
+
+upstream dle_proxy {
+    server {{.Upstream}};
+    keepalive 32;
+}
+{{range .Sites}}
+server {
+    listen {{$.Listen}};
+    server_name {{.Host}};
+
+    location / {
+        proxy_pass http://dle_proxy;
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection $dle_proxy_connection;
+        proxy_set_header Host $host;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+    }
+}
+{{- if .Aliases}}
+
+server {
+    listen {{$.Listen}};
+    server_name {{join .Aliases " "}};
+    return 301 https://{{.Host}}$request_uri;
+}
+{{- end}}
+{{end}}`))
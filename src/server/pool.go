@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceURIHash    = "uri-hash"
+)
+
+var errNoUpstream = errors.New("no upstream")
+
+type upstream struct {
+	url     string
+	active  atomic.Int64 // requests in flight
+	healthy atomic.Bool  // last active health check
+}
+
+// pool is a set of upstreams from one service field: "http://dle1,http://dle2"
+type pool struct {
+	backend   string
+	balance   string
+	service   string
+	host      string // Host header of health checks, empty - host of the upstream url
+	upstreams []*upstream
+	next      atomic.Uint64
+	cancel    context.CancelFunc // stops health checker when the pool is evicted
+}
+
+// serviceURLs splits comma separated service field
+func serviceURLs(service string) (urls []string) {
+	for _, u := range strings.Split(service, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return
+}
+
+// base is the first upstream url, for logs and the initial request url
+func (p *pool) base() string {
+	if len(p.upstreams) == 0 {
+		return ""
+	}
+	return p.upstreams[0].url
+}
+
+// pick chooses upstream by pool balance skipping unhealthy ones and ones whose breaker would reject.
+// When nothing is available it picks among all, the breaker decides what happens next.
+func (p *pool) pick(s *Service, key string, exclude *upstream) *upstream {
+	var candidates []*upstream
+	for _, u := range p.upstreams {
+		if u != exclude && u.healthy.Load() && s.breaker(p.backend, u.url).available() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.balance {
+	case balanceLeastConn:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	case balanceURIHash:
+		// rendezvous hashing: uri keeps its upstream while the set doesn't change
+		var best *upstream
+		var bestScore uint64
+		for _, u := range candidates {
+			h := fnv.New64a()
+			io.WriteString(h, u.url)
+			io.WriteString(h, key)
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	}
+	return candidates[p.next.Add(1)%uint64(len(candidates))]
+}
+
+// poolKey identifies a pool, dle pools are per private host so health checks reach the right site
+func poolKey(backend, balance, host, service string) string {
+	return backend + " " + balance + " " + host + " " + service
+}
+
+// pool returns pool for backend service, created on first use with its health checker
+func (s *Service) pool(be *backend, service, balance, host string) *pool {
+	key := poolKey(be.name, balance, host, service)
+	s.poolsMu.Lock()
+	defer s.poolsMu.Unlock()
+	p, ok := s.pools[key]
+	if ok {
+		return p
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	p = &pool{backend: be.name, balance: balance, service: service, host: host, cancel: cancel}
+	for _, u := range serviceURLs(service) {
+		up := &upstream{url: u}
+		up.healthy.Store(true)
+		p.upstreams = append(p.upstreams, up)
+	}
+	s.pools[key] = p
+
+	path := backendEnv(be.name, "HEALTH_PATH")
+	if path != "" && len(p.upstreams) > 1 {
+		go s.healthWorker(ctx, be, p, path, backendDuration(be.name, "HEALTH_INTERVAL", 10*time.Second))
+	}
+	return p
+}
+
+// poolWorker evicts pools, their health checkers and breakers once no domain uses the service field
+func (s *Service) poolWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		s.evictPools()
+	}
+}
+
+func (s *Service) evictPools() {
+	domains, err := s.domainService.GetDomains()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// pools route can ask for, see Service.route
+	live := map[string]bool{}
+	for _, d := range domains {
+		live[poolKey(backendDle, d.Balance, d.HostPrivate, d.ServiceDle)] = true
+		live[poolKey(backendImager, d.Balance, "", d.ServiceImager)] = true
+		live[poolKey(backendImaginary, d.Balance, "", imaginaryHost)] = true
+		live[poolKey(backendStater, d.Balance, "", staterHost)] = true
+		live[poolKey(backendSitemap, d.Balance, "", d.ServiceSitemap)] = true
+		live[poolKey(backendDns, d.Balance, "", d.ServiceDns)] = true
+	}
+
+	s.poolsMu.Lock()
+	upstreams := map[string]bool{}
+	for key, p := range s.pools {
+		if !live[key] {
+			log.Println("pool evicted", p.backend, p.service)
+			p.cancel()
+			delete(s.pools, key)
+			continue
+		}
+		for _, u := range p.upstreams {
+			upstreams[p.backend+" "+u.url] = true
+		}
+	}
+	s.poolsMu.Unlock()
+
+	s.breakersMu.Lock()
+	for key := range s.breakers {
+		if !upstreams[key] {
+			delete(s.breakers, key)
+		}
+	}
+	s.breakersMu.Unlock()
+}
+
+// healthWorker marks upstreams down while GET path fails or answers 5xx
+func (s *Service) healthWorker(ctx context.Context, be *backend, p *pool, path string, interval time.Duration) {
+	client := &http.Client{Transport: be.transport, Timeout: interval}
+	for {
+		for _, u := range p.upstreams {
+			healthy := false
+			resp, err := healthGet(ctx, client, p.host, u.url+path)
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				healthy = resp.StatusCode < http.StatusInternalServerError
+			}
+			if u.healthy.Swap(healthy) != healthy {
+				log.Println("upstream", be.name, u.url, "healthy:", healthy, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// healthGet requests url with Host set to host unless empty, dle answers only for its private host
+func healthGet(ctx context.Context, client *http.Client, host, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	return client.Do(req)
+}
+
+type poolUpstreamStatus struct {
+	Backend string `json:"backend"`
+	Balance string `json:"balance"`
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Active  int64  `json:"active"`
+}
+
+func (s *Service) upstreamStatuses() (list []poolUpstreamStatus) {
+	s.poolsMu.Lock()
+	defer s.poolsMu.Unlock()
+	for _, p := range s.pools {
+		for _, u := range p.upstreams {
+			list = append(list, poolUpstreamStatus{Backend: p.backend, Balance: p.balance, URL: u.url, Healthy: u.healthy.Load(), Active: u.active.Load()})
+		}
+	}
+	return
+}
+
+// activeBody decrements upstream in-flight counter when the response body is closed
+type activeBody struct {
+	io.ReadCloser
+	once sync.Once
+	up   *upstream
+}
+
+func (b *activeBody) Close() error {
+	b.once.Do(func() { b.up.active.Add(-1) })
+	return b.ReadCloser.Close()
+}
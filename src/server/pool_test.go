@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthGetHost(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Host
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "example.local", want: "example.local"},
+		{host: "", want: strings.TrimPrefix(ts.URL, "http://")},
+	}
+	for _, tt := range tests {
+		resp, err := healthGet(context.Background(), ts.Client(), tt.host, ts.URL+"/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got != tt.want {
+			t.Errorf("host %q: upstream got Host %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	s := &Service{ctx: context.Background(), pools: map[string]*pool{}}
+	dle := &backend{name: backendDle}
+	a := s.pool(dle, "http://dle", balanceRoundRobin, "a.local")
+	b := s.pool(dle, "http://dle", balanceRoundRobin, "b.local")
+	if a == b {
+		t.Fatal("domains with different private hosts share a dle pool")
+	}
+	if s.pool(dle, "http://dle", balanceRoundRobin, "a.local") != a {
+		t.Fatal("pool not reused")
+	}
+	if _, ok := s.pools[poolKey(backendDle, balanceRoundRobin, "a.local", "http://dle")]; !ok {
+		t.Fatal("pool stored under another key than evictPools checks")
+	}
+}
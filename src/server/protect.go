@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dle-proxy/database/domain"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// login form for cookie protected paths, served on every domain
+const authPrefix = "/_auth/"
+
+const authCookie = "dle_proxy_auth"
+
+// compared when the login is unknown so it takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Login</title></head>
+<body style="font-family:sans-serif;text-align:center;padding-top:10%">
+<form method="post" action="/_auth/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<p><input name="login" placeholder="login" autofocus></p>
+<p><input name="password" type="password" placeholder="password"></p>
+{{if .Error}}<p style="color:#c00">{{.Error}}</p>{{end}}
+<p><button type="submit">Login</button></p>
+</form>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Next  string
+	Error string
+}
+
+// authSecret is AUTH_SECRET, random when not set so cookies don't survive restarts
+func authSecret() []byte {
+	if secret := envString("AUTH_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	log.Println("AUTH_SECRET is not set, login cookies are valid until restart")
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// protectedPath applies flix_protected_paths, true when the request was answered
+func (s *Service) protectedPath(w http.ResponseWriter, r *http.Request, dom domain.Domain, c client, requestID string) bool {
+	if s.protectedPathService == nil {
+		return false
+	}
+	rule, err := s.protectedPathService.GetPath(dom.ID, protectedURI(r.URL))
+	if err != nil {
+		return false
+	}
+
+	if rule.Mode == "deny" || !rule.Allows(c.ip) {
+		log.Printf("%s (%s) %s 404 protected path %d, %s\n", r.Method, dom.HostPublic, r.URL.String(), rule.ID, c.ip)
+		s.metrics.inc("dle_proxy_protected_denied_total", "domain", dom.HostPublic, "mode", rule.Mode)
+		s.errorPage(w, dom.ID, http.StatusNotFound, requestID)
+		return true
+	}
+
+	switch rule.Mode {
+	case "basic":
+		if login, password, ok := r.BasicAuth(); ok && s.checkPassword(dom.ID, login, password) {
+			// the password is ours, not dle's
+			r.Header.Del("Authorization")
+			return false
+		}
+		s.metrics.inc("dle_proxy_protected_denied_total", "domain", dom.HostPublic, "mode", rule.Mode)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, dom.HostPublic))
+		s.errorPage(w, dom.ID, http.StatusUnauthorized, requestID)
+		return true
+	case "cookie":
+		if s.authCookieValid(r, dom) {
+			return false
+		}
+		s.metrics.inc("dle_proxy_protected_denied_total", "domain", dom.HostPublic, "mode", rule.Mode)
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, authPrefix+"login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return true
+	}
+	return false
+}
+
+// protectedURI is path with query for rule matching. Apache merges slashes and dot segments, so must we.
+func protectedURI(u *url.URL) string {
+	uri := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && uri != "/" {
+		uri += "/"
+	}
+	if u.RawQuery != "" {
+		uri += "?" + u.RawQuery
+	}
+	return uri
+}
+
+// localRedirect returns next when it's a path on this host, / otherwise. Browsers drop tabs and
+// newlines and read \ as /, so /%09/evil.com or /\evil.com would leave the site.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || unsafeRedirectPath(next) {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return "/"
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || unsafeRedirectPath(u.Path) {
+		return "/"
+	}
+	return next
+}
+
+// unsafeRedirectPath reports backslashes and control characters
+func unsafeRedirectPath(p string) bool {
+	return strings.ContainsFunc(p, func(c rune) bool {
+		return c == '\\' || c < 0x20 || c == 0x7f
+	})
+}
+
+func (s *Service) checkPassword(domainID int, login, password string) bool {
+	hash := dummyHash
+	user, err := s.protectedPathService.GetUser(domainID, login)
+	if err == nil {
+		hash = []byte(user.PasswordHash)
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && err == nil
+}
+
+// authCookieSignature covers domain, login and expiry
+func (s *Service) authCookieSignature(domainID int, login string, expires int64) string {
+	mac := hmac.New(sha256.New, s.authSecret)
+	fmt.Fprintf(mac, "%d|%s|%d", domainID, login, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authCookieValid checks <login>|<expires>|<signature> cookie, login is base64url.
+// The user must still exist, so deleting the row logs them out.
+func (s *Service) authCookieValid(r *http.Request, dom domain.Domain) bool {
+	cookie, err := r.Cookie(authCookie)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(cookie.Value, "|")
+	if len(parts) != 3 {
+		return false
+	}
+	login, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.authCookieSignature(dom.ID, string(login), expires))) {
+		return false
+	}
+	_, err = s.protectedPathService.GetUser(dom.ID, string(login))
+	return err == nil
+}
+
+// authHandler serves /_auth/login and /_auth/logout
+func (s *Service) authHandler(w http.ResponseWriter, r *http.Request, dom domain.Domain, c client, class, requestID string) {
+	if s.protectedPathService == nil {
+		s.errorPage(w, dom.ID, http.StatusNotFound, requestID)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.URL.Path {
+	case authPrefix + "logout":
+		http.SetCookie(w, &http.Cookie{Name: authCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	case authPrefix + "login":
+	default:
+		s.errorPage(w, dom.ID, http.StatusNotFound, requestID)
+		return
+	}
+
+	data := loginPageData{Next: localRedirect(r.FormValue("next"))}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		if s.rateLimited(w, dom, c, class, limitAuth, requestID) {
+			return
+		}
+		login := r.PostFormValue("login")
+		if s.checkPassword(dom.ID, login, r.PostFormValue("password")) {
+			expires := time.Now().Add(s.authCookieTTL).Unix()
+			value := base64.RawURLEncoding.EncodeToString([]byte(login)) + "|" + strconv.FormatInt(expires, 10) + "|" + s.authCookieSignature(dom.ID, login, expires)
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookie,
+				Value:    value,
+				Path:     "/",
+				MaxAge:   int(s.authCookieTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   c.proto == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+			log.Printf("(%s) %s login %s\n", dom.HostPublic, c.ip, login)
+			http.Redirect(w, r, data.Next, http.StatusFound)
+			return
+		}
+		log.Printf("(%s) %s login failed %s\n", dom.HostPublic, c.ip, login)
+		s.metrics.inc("dle_proxy_protected_denied_total", "domain", dom.HostPublic, "mode", "login")
+		data.Error = "Wrong login or password"
+		status = http.StatusUnauthorized
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	loginPage.Execute(w, data)
+}
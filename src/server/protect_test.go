@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{next: "/admin.php?mod=main", want: "/admin.php?mod=main"},
+		{next: "/news/1.html#comments", want: "/news/1.html#comments"},
+		{next: "/a%2Fb", want: "/a%2Fb"},
+		{next: "", want: "/"},
+		{next: "admin.php", want: "/"},
+		{next: "https://evil.com/", want: "/"},
+		{next: "//evil.com", want: "/"},
+		{next: "///evil.com", want: "/"},
+		{next: "/\\evil.com", want: "/"},
+		{next: "/a\\b", want: "/"},
+		{next: "/%09/evil.com", want: "/"},
+		{next: "/\t/evil.com", want: "/"},
+		{next: "/%0a/evil.com", want: "/"},
+		{next: "/%2F/evil.com", want: "/"},
+		{next: "/%5Cevil.com", want: "/"},
+		{next: "/%7f", want: "/"},
+		{next: "/%zz", want: "/"},
+		{next: "javascript:alert(1)", want: "/"},
+		{next: "/\x00", want: "/"},
+	}
+	for _, tt := range tests {
+		if got := localRedirect(tt.next); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestProtectedURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{uri: "/admin.php?mod=main", want: "/admin.php?mod=main"},
+		{uri: "//admin.php", want: "/admin.php"},
+		{uri: "/x/../admin.php", want: "/admin.php"},
+		{uri: "/engine/./ajax/", want: "/engine/ajax/"},
+		{uri: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		u, err := url.ParseRequestURI(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := protectedURI(u); got != tt.want {
+			t.Errorf("protectedURI(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"dle-proxy/database/domain"
 	"fmt"
 	"io"
 	"log"
@@ -11,17 +13,22 @@ import (
 	"time"
 )
 
+const staterHost = "http://stater"
+
 // Hop-by-hop headers. These are removed when sent to the backend.
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// Headers listed in Connection are hop-by-hop as well, see connectionHeaders.
 var hopHeaders = []string{
-	//"Connection",
-	//"Keep-Alive",
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"Te", // canonicalized version of "TE"
+	"Trailer",
 	"Trailers",
 	"Transfer-Encoding",
-	//"Upgrade",
+	"Upgrade",
 }
 
 func (s *Service) Proxy(w http.ResponseWriter, r *http.Request) {
@@ -33,21 +40,36 @@ func (s *Service) Proxy(w http.ResponseWriter, r *http.Request) {
 
 	start := time.Now()
 
+	if s.isAdminPath(r.URL.Path) {
+		s.adminHandler.ServeHTTP(w, r)
+		return
+	}
+
+	requestID := newRequestID()
+	w.Header().Set("X-Request-Id", requestID)
+
 	forbiddenReplaceDomain := false
 
+	// real client ip, forwarding headers are trusted only from TRUSTED_PROXIES
+	client := s.clientOf(r)
+
+	// flix_domain.header_policy over HEADER_POLICY on everything written from here on
+	pw := &policyWriter{ResponseWriter: w, policies: s.headerPolicies, https: client.proto == "https"}
+	w = pw
+
 	// get domain settings
 	// r.Host with port like proxy2.cis-dle.orb.local:8090
-	hostFull := strings.Split(r.Host, ":")
-	hostHeader := r.Header.Get("X-Forwarded-Host")
-	if hostHeader != "" {
-		hostFull = strings.Split(hostHeader, ":")
-	}
-	host := hostFull[0]
+	host := requestHost(r, client)
 	path := r.URL.Path
 	uri := r.URL.String()
 
 	//log.Println(host, path)
 
+	// ip, cidr and asn lists from flix_access_lists
+	if s.accessDenied(w, r, s.domainIDOf(host), client, requestID) {
+		return
+	}
+
 	// check if this domain is alias so we need to redirect to main domain
 	alias, err := s.domainAliasService.GetDomain(host)
 	if err == nil {
@@ -64,7 +86,49 @@ func (s *Service) Proxy(w http.ResponseWriter, r *http.Request) {
 	dom, err := s.domainService.GetDomain(host)
 	if err != nil {
 		log.Println("Proxy error - domain ["+host+"] not found", err)
-		http.Error(w, "Proxy error - domain ["+host+"] not found", http.StatusNotFound)
+		s.errorPage(w, 0, http.StatusNotFound, requestID)
+		return
+	}
+	pw.dom = dom
+
+	// human, search-bot, fake-search-bot or bot
+	class := s.classify(r, client)
+	s.metrics.inc("dle_proxy_requests_total", "domain", dom.HostPublic, "class", class)
+	if class == classFakeBot && s.fakeBotAction == "block" {
+		log.Printf("%s (%s) %s 403 fake search bot %s %q\n", r.Method, host, uri, client.ip, r.UserAgent())
+		s.errorPage(w, dom.ID, http.StatusForbidden, requestID)
+		return
+	}
+
+	// GEOIP_DB or CF-IPCountry from trusted proxies, flix_domain_geo may block or redirect
+	country := s.clientCountry(r, client)
+	if s.geoRule(w, r, dom, country, requestID) {
+		return
+	}
+
+	// flix_domain.cors preflights are answered here, they carry no cookies for login or challenge
+	if s.corsPreflight(w, r, dom) {
+		return
+	}
+
+	// login form for cookie protected paths
+	if strings.HasPrefix(path, authPrefix) {
+		s.authHandler(w, r, dom, client, class, requestID)
+		return
+	}
+
+	if path == challengePath {
+		s.challengeVerify(w, r, dom, client)
+		return
+	}
+
+	// flix_protected_paths: ip allowlist, basic auth, login cookie or 404
+	if s.protectedPath(w, r, dom, client, requestID) {
+		return
+	}
+
+	// flix_waf_rules and starter rules for dle exploit probes
+	if s.waf(w, r, dom, client, class, requestID) {
 		return
 	}
 
@@ -110,55 +174,67 @@ Host: https://` + host + `/`))
 		}
 	}
 
-	targetHost := dom.ServiceDle
-	if strings.HasPrefix(uri, "/posts/") || strings.HasPrefix(uri, "/fotos/") {
-		targetHost = dom.ServiceImager
-		forbiddenReplaceDomain = true
+	// flix_domain.challenge during scraping waves
+	if dom.Challenge && s.challenge(w, r, dom, client, class, requestID) {
+		return
 	}
 
-	if strings.HasPrefix(uri, "/stater/") {
-		targetHost = "http://stater"
-		forbiddenReplaceDomain = true
+	rt, status, err := s.route(dom, r, uri)
+	if err != nil {
+		log.Printf("%s (%s) %s %d %s\n", r.Method, host, r.URL.String(), status, err)
+		if status == http.StatusForbidden {
+			http.Error(w, "Forbidden", status)
+		} else {
+			http.Error(w, err.Error(), status)
+		}
+		return
 	}
+	targetHost, be, uri, varyAccept := rt.targetHost, rt.be, rt.uri, rt.varyAccept
+	forbiddenReplaceDomain = rt.forbiddenReplaceDomain
 
-	if strings.HasPrefix(uri, "/resize/") || strings.HasPrefix(uri, "/crop/") {
-		targetHost = "http://imaginary:8088"
-		//path = strings.ReplaceAll(path, "/resize/", "/crop/")
-		uri = strings.ReplaceAll(uri, "?w=", "?width=")
-		uri = strings.ReplaceAll(uri, "?h=", "?height=")
-		uri = strings.ReplaceAll(uri, "&w=", "&width=")
-		uri = strings.ReplaceAll(uri, "&h=", "&height=")
-		forbiddenReplaceDomain = true
-	}
+	pw.kind = be.name
 
-	if strings.HasPrefix(uri, "/sitemap") {
-		targetHost = dom.ServiceSitemap
-		forbiddenReplaceDomain = true
+	// images embedded by other sites, flix_domain.hotlink_mode
+	if (be.name == backendImager || be.name == backendImaginary) && s.hotlinked(w, r, dom, requestID) {
+		return
 	}
 
-	if path == "/traefik" {
-		targetHost = dom.ServiceDns
-		forbiddenReplaceDomain = true
+	if s.rateLimited(w, dom, client, class, limitKind(r, be), requestID) {
+		return
 	}
 
+	// targetHost may be a list of upstreams, roundTrip picks one
+	p := s.pool(be, targetHost, dom.Balance, rt.host)
+
 	// Create a new HTTP request with the same method, URL, and body as the original request
-	targetURL := targetHost + uri
+	targetURL := p.base() + uri
+
+	// websocket and other protocol switches, tunnelled after 101
+	upgrade := upgradeType(r.Header)
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	ctx, cancel := context.WithTimeout(r.Context(), be.timeout)
+	if upgrade != "" {
+		// tunnel lives as long as the client keeps it
+		cancel()
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	defer cancel()
+
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, r.Body)
 	if err != nil {
 		log.Println(err)
 		log.Println("Error creating proxy request", err.Error())
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+		s.errorPage(w, dom.ID, http.StatusInternalServerError, requestID)
 		return
 	}
 
-	// replace host only for dle
-	if targetHost == dom.ServiceDle {
-		proxyReq.Host = dom.HostPrivate
+	if rt.host != "" {
+		proxyReq.Host = rt.host
 	}
 
 	// Copy the headers from the original request to the proxy request
 	//log.Println("REQUEST")
+	connHeaders := connectionHeaders(r.Header)
 	for name, values := range r.Header {
 		for _, value := range values {
 			//log.Println(name, value)
@@ -168,7 +244,10 @@ Host: https://` + host + `/`))
 			if name == "Referer" {
 				value = strings.ReplaceAll(value, host, dom.HostPrivate)
 			}
-			if isHopHeader(name) {
+			if isHopHeader(name) || connHeaders[name] || forwardedHeaders[name] {
+				continue
+			}
+			if trustedOnlyHeaders[name] && !client.cloudflare {
 				continue
 			}
 
@@ -181,15 +260,51 @@ Host: https://` + host + `/`))
 	proxyReq.Header.Add("X-Domain-Id", fmt.Sprintf("%d", dom.ID))
 	proxyReq.Header.Add("X-Domain-Host", dom.HostPublic)
 	proxyReq.Header.Add("X-Domain-Skin", dom.Skin)
+	proxyReq.Header.Set("X-Request-Id", requestID)
+	proxyReq.Header.Set("X-Client-Class", class)
+	if country != "" {
+		proxyReq.Header.Set("X-Country", country)
+	}
+	setForwardedHeaders(proxyReq.Header, r, client, host)
+	if upgrade != "" {
+		proxyReq.Header.Set("Connection", "Upgrade")
+		proxyReq.Header.Set("Upgrade", upgrade)
+	}
+
+	// last good response is served when the backend fails (flix_domain.stale_max_age)
+	cacheKey := staleKey(dom, r.URL.String(), country, class)
+	if varyAccept {
+		cacheKey += " " + negotiateImageFormat(dom, r.Header.Get("Accept"))
+	}
+	useStale := be.name != backendStater && be.name != backendDns
+	if useStale && upgrade == "" && s.serveFresh(w, r, dom, be.name, cacheKey, varyAccept, requestID) {
+		return
+	}
+	fail := func(err error) {
+		if useStale && s.serveStale(w, r, dom, be.name, cacheKey, requestID, err) {
+			return
+		}
+		s.upstreamError(w, r, dom.ID, requestID, fmt.Errorf("%s %s: %w", be.name, targetURL, err))
+	}
 
 	//Send the proxy request using the custom transport
-	resp, err := s.customTransport.RoundTrip(proxyReq)
+	resp, err := s.roundTrip(be, p, uri, proxyReq)
 	if err != nil {
-		log.Println("Proxy error", err)
-		http.Error(w, "Proxy error", http.StatusInternalServerError)
+		fail(err)
 		return
 	}
 	defer resp.Body.Close()
+	targetURL = resp.Request.URL.String()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		log.Printf("%s (%s) %s 101 %s\n", r.Method, host, targetURL, upgrade)
+		s.serveUpgrade(w, r, resp)
+		return
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError && useStale && s.serveStale(w, r, dom, be.name, cacheKey, requestID, fmt.Errorf("status %d", resp.StatusCode)) {
+		return
+	}
 
 	pubURL := dom.SchemePublic + "://" + dom.HostPublic
 	if dom.PortPublic != "" {
@@ -199,7 +314,11 @@ Host: https://` + host + `/`))
 	// Copy the headers from the proxy response to the original response
 	needReplaceDomain := false
 	needReplaceCanonical := false
+	respConnHeaders := connectionHeaders(resp.Header)
 	for name, values := range resp.Header {
+		if isHopHeader(name) || respConnHeaders[name] {
+			continue
+		}
 		for _, value := range values {
 			if name == "X-Powered-By" {
 				continue
@@ -224,9 +343,17 @@ Host: https://` + host + `/`))
 			w.Header().Add(name, value)
 		}
 	}
+	if varyAccept {
+		addVary(w.Header(), "Accept")
+	}
+	s.corsHeaders(w.Header(), r, dom)
 
 	if needReplaceDomain && !forbiddenReplaceDomain {
-		body, _ := io.ReadAll(resp.Body)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			fail(err)
+			return
+		}
 
 		//log.Printf("%s %d R\n", path, len(body))
 
@@ -243,7 +370,9 @@ Host: https://` + host + `/`))
 		//body = bytes.ReplaceAll(body, []byte("https://"+dom.HostPrivate), []byte(pubURL))
 
 		// remove S3 domain for images
-		body = bytes.ReplaceAll(body, []byte(dom.ServiceImager), []byte(""))
+		for _, imager := range serviceURLs(dom.ServiceImager) {
+			body = bytes.ReplaceAll(body, []byte(imager), []byte(""))
+		}
 
 		// cache breaker for all images
 		//body = bytes.ReplaceAll(body, []byte(".jpg\""), []byte(".jpg?v=1\""))
@@ -258,6 +387,9 @@ Host: https://` + host + `/`))
 
 		w.Header().Set("X-Proxy-Mode", "modified")
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		if useStale {
+			s.storeStale(r, dom, be.name, cacheKey, resp.StatusCode, w.Header(), body)
+		}
 
 		log.Printf("%s (%s) %s %d R\n", r.Method, host, targetURL, len(body))
 
@@ -270,10 +402,17 @@ Host: https://` + host + `/`))
 	//log.Printf("%s\n", path)
 
 	// это тупо конечно вычитывать ответ только чтобы узнать его длину но апач не передает Content-Length
-	body, _ := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fail(err)
+		return
+	}
 	log.Printf("%s (%s) %s %d D\n", r.Method, host, targetURL, len(body))
 	w.Header().Set("X-Proxy-Mode", "direct")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	if useStale {
+		s.storeStale(r, dom, be.name, cacheKey, resp.StatusCode, w.Header(), body)
+	}
 	w.Header().Add("X-Proxy-tm", fmt.Sprintf("%d", time.Since(start).Milliseconds()))
 	w.WriteHeader(resp.StatusCode)
 	w.Write(body)
@@ -288,3 +427,73 @@ func isHopHeader(header string) bool {
 	}
 	return false
 }
+
+// route is the upstream a request goes to
+type route struct {
+	targetHost             string // upstream url, may be a list for the pool
+	be                     *backend
+	uri                    string
+	host                   string // outgoing Host header, empty - host of targetHost
+	varyAccept             bool   // response depends on Accept (webp/avif negotiation)
+	forbiddenReplaceDomain bool
+}
+
+// route picks the backend by uri, a non-zero status is returned with a client error
+func (s *Service) route(dom domain.Domain, r *http.Request, uri string) (rt route, status int, err error) {
+	path := r.URL.Path
+
+	rt = route{targetHost: dom.ServiceDle, be: s.backends[backendDle], uri: uri}
+	if strings.HasPrefix(uri, "/posts/") || strings.HasPrefix(uri, "/fotos/") {
+		rt.targetHost = dom.ServiceImager
+		rt.be = s.backends[backendImager]
+		if dom.ImageFormats != "" && isConvertibleImage(path) {
+			rt.varyAccept = true
+			if format := negotiateImageFormat(dom, r.Header.Get("Accept")); format != "" {
+				rt.targetHost = imaginaryHost
+				rt.be = s.backends[backendImaginary]
+				rt.uri = imagerConvertURI(dom, uri, format)
+			}
+		}
+		rt.forbiddenReplaceDomain = true
+	}
+
+	if strings.HasPrefix(uri, "/stater/") {
+		rt.targetHost = staterHost
+		rt.be = s.backends[backendStater]
+		rt.forbiddenReplaceDomain = true
+	}
+
+	if strings.HasPrefix(uri, "/resize/") || strings.HasPrefix(uri, "/crop/") {
+		rt.targetHost = imaginaryHost
+		rt.be = s.backends[backendImaginary]
+		if err := checkImageURL(dom, r.URL); err != nil {
+			return rt, http.StatusForbidden, err
+		}
+		autoFormat := negotiateImageFormat(dom, r.Header.Get("Accept"))
+		rt.uri, rt.varyAccept, err = imaginaryURI(r.URL, autoFormat)
+		rt.varyAccept = rt.varyAccept && dom.ImageFormats != ""
+		if err != nil {
+			return rt, http.StatusBadRequest, err
+		}
+		rt.forbiddenReplaceDomain = true
+	}
+
+	if strings.HasPrefix(uri, "/sitemap") {
+		rt.targetHost = dom.ServiceSitemap
+		rt.be = s.backends[backendSitemap]
+		rt.forbiddenReplaceDomain = true
+	}
+
+	if path == "/traefik" {
+		rt.targetHost = dom.ServiceDns
+		rt.be = s.backends[backendDns]
+		rt.forbiddenReplaceDomain = true
+	}
+
+	// replace host only for dle
+	if rt.be.name == backendDle {
+		rt.host = dom.HostPrivate
+	}
+
+	return rt, 0, nil
+}
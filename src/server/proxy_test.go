@@ -0,0 +1,56 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	s := &Service{backends: map[string]*backend{}}
+	for _, name := range backendNames {
+		s.backends[name] = &backend{name: name}
+	}
+	dom := domain.Domain{
+		HostPublic:     "example.com",
+		HostPrivate:    "example.local",
+		ServiceDle:     "http://dle",
+		ServiceImager:  "http://imager",
+		ServiceSitemap: "http://sitemap",
+		ServiceDns:     "http://dns",
+		ResizeSecret:   "secret",
+	}
+
+	tests := []struct {
+		uri     string
+		target  string
+		backend string
+		host    string
+		status  int
+	}{
+		{uri: "/", target: "http://dle", backend: backendDle, host: "example.local"},
+		{uri: "/index.php?do=search", target: "http://dle", backend: backendDle, host: "example.local"},
+		{uri: "/traefik", target: "http://dns", backend: backendDns},
+		{uri: "/traefik?x=1", target: "http://dns", backend: backendDns},
+		{uri: "/sitemap.xml", target: "http://sitemap", backend: backendSitemap},
+		{uri: "/stater/hit", target: staterHost, backend: backendStater},
+		{uri: "/posts/2024/a.jpg", target: "http://imager", backend: backendImager},
+		{uri: "/resize/?url=http://imager/a.jpg&w=100", backend: backendImaginary, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+			rt, status, err := s.route(dom, r, r.URL.String())
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d (%v)", status, tt.status, err)
+			}
+			if tt.status != 0 {
+				return
+			}
+			if rt.targetHost != tt.target || rt.be.name != tt.backend || rt.host != tt.host {
+				t.Errorf("route = %s %s host %q, want %s %s host %q", rt.targetHost, rt.be.name, rt.host, tt.target, tt.backend, tt.host)
+			}
+		})
+	}
+}
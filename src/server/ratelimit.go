@@ -0,0 +1,191 @@
+package server
+
+import (
+	"container/list"
+	"dle-proxy/database/domain"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rate limit kinds besides backend names
+const (
+	limitSearch = "search" // dle /index.php?do=search
+	limitResize = "resize" // /resize/ and /crop/
+	limitAll    = "all"    // every request to the domain
+	limitAuth   = "auth"   // /_auth/login attempts
+)
+
+type bucketLimit struct {
+	rate  float64 // tokens per second
+	burst float64
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps token buckets in a bounded lru. A dropped bucket starts full again,
+// so running out of slots only makes limits softer.
+type rateLimiter struct {
+	mu      sync.Mutex
+	max     int
+	ll      *list.List
+	buckets map[string]*list.Element
+}
+
+func newRateLimiter(max int) *rateLimiter {
+	return &rateLimiter{max: max, ll: list.New(), buckets: map[string]*list.Element{}}
+}
+
+// take removes a token from the bucket, returns how long to wait for the next one when it's empty
+func (l *rateLimiter) take(key string, limit bucketLimit, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *tokenBucket
+	if el, ok := l.buckets[key]; ok {
+		l.ll.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+		b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+		b.last = now
+	} else {
+		b = &tokenBucket{key: key, tokens: limit.burst, last: now}
+		l.buckets[key] = l.ll.PushFront(b)
+		for l.ll.Len() > l.max {
+			el := l.ll.Back()
+			l.ll.Remove(el)
+			delete(l.buckets, el.Value.(*tokenBucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+func (l *rateLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
+
+// parseRateLimit reads "rate,burst", burst defaults to rate rounded up
+func parseRateLimit(v string) (limit bucketLimit, err error) {
+	rate, burst, _ := strings.Cut(v, ",")
+	if limit.rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil {
+		return
+	}
+	if burst = strings.TrimSpace(burst); burst != "" {
+		var b int
+		if b, err = strconv.Atoi(burst); err != nil {
+			return
+		}
+		limit.burst = float64(b)
+	}
+	return limit, nil
+}
+
+// envRateLimits reads RATE_LIMIT_<KIND>=rate,burst and RATE_LIMIT_<KIND>_<CLASS>=rate,burst
+// defaults for domains without flix_rate_limits rows, class like FAKE_SEARCH_BOT.
+// Login attempts are limited even without RATE_LIMIT_AUTH, set it to 0 to turn that off.
+func envRateLimits() map[string]bucketLimit {
+	limits := map[string]bucketLimit{}
+	for _, kind := range append([]string{limitSearch, limitResize, limitAll, limitAuth}, backendNames...) {
+		for _, class := range append([]string{""}, clientClasses...) {
+			name := "RATE_LIMIT_" + strings.ToUpper(kind)
+			if class != "" {
+				name += "_" + strings.ToUpper(strings.ReplaceAll(class, "-", "_"))
+			}
+			v := envString(name, "")
+			if v == "" {
+				continue
+			}
+			limit, err := parseRateLimit(v)
+			if err != nil {
+				log.Printf("bad %s=%s: %s", name, v, err)
+				continue
+			}
+			limits[strings.TrimSpace(kind+" "+class)] = limit
+		}
+	}
+	if _, ok := limits[limitAuth]; !ok {
+		limits[limitAuth] = bucketLimit{rate: 0.2, burst: 5}
+	}
+	return limits
+}
+
+// rateLimitFor returns flix_rate_limits row for the domain, then the global row, then env default
+func (s *Service) rateLimitFor(domainID int, kind, class string) (bucketLimit, bool) {
+	limit, ok := s.rateLimits[kind+" "+class]
+	if !ok {
+		limit, ok = s.rateLimits[kind]
+	}
+	if s.rateLimitService != nil {
+		if row, err := s.rateLimitService.GetLimit(domainID, kind, class); err == nil {
+			limit, ok = bucketLimit{rate: row.Rate, burst: float64(row.Burst)}, true
+		}
+	}
+	if !ok || limit.rate <= 0 {
+		return limit, false
+	}
+	if limit.burst < 1 {
+		limit.burst = math.Max(1, math.Ceil(limit.rate))
+	}
+	return limit, true
+}
+
+// limitKind is the rate limit kind of a request routed to be
+func limitKind(r *http.Request, be *backend) string {
+	if strings.HasPrefix(r.URL.Path, "/resize/") || strings.HasPrefix(r.URL.Path, "/crop/") {
+		return limitResize
+	}
+	if be.name == backendDle && r.URL.Query().Get("do") == "search" {
+		return limitSearch
+	}
+	return be.name
+}
+
+// limitAddr groups ipv6 clients by /64, they usually get the whole network
+func limitAddr(addr netip.Addr) string {
+	if addr.Is6() {
+		addr = netip.PrefixFrom(addr, 64).Masked().Addr()
+	}
+	return addr.String()
+}
+
+// rateLimited answers 429 when the client ran out of tokens for the kind or for all requests to the domain.
+// RATE_LIMIT_ALLOWLIST clients are never limited.
+func (s *Service) rateLimited(w http.ResponseWriter, dom domain.Domain, c client, class, kind, requestID string) bool {
+	if containsAddr(s.rateLimitAllow, c.ip) {
+		return false
+	}
+	for _, k := range []string{kind, limitAll} {
+		limit, ok := s.rateLimitFor(dom.ID, k, class)
+		if !ok {
+			continue
+		}
+		// class picks the limit, not the bucket: changing user agent doesn't buy new tokens
+		key := fmt.Sprintf("%s %d %s", limitAddr(c.ip), dom.ID, k)
+		wait, ok := s.limiter.take(key, limit, time.Now())
+		if ok {
+			continue
+		}
+		log.Printf("(%s) %s %s rate limited %s, retry in %s\n", dom.HostPublic, c.ip, class, k, wait)
+		s.metrics.inc("dle_proxy_rate_limited_total", "domain", dom.HostPublic, "kind", k, "class", class)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.errorPage(w, dom.ID, http.StatusTooManyRequests, requestID)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter(10)
+	limit := bucketLimit{rate: 1, burst: 2}
+	now := time.Now()
+
+	steps := []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{ok: true},
+		{ok: true},
+		{ok: false, wait: time.Second},
+		{after: 500 * time.Millisecond, ok: false, wait: 500 * time.Millisecond},
+		{after: 500 * time.Millisecond, ok: true},
+		{after: 10 * time.Second, ok: true},
+		{ok: true},
+		{ok: false, wait: time.Second},
+	}
+	for i, st := range steps {
+		now = now.Add(st.after)
+		wait, ok := l.take("k", limit, now)
+		if ok != st.ok || wait != st.wait {
+			t.Errorf("step %d: take = %s %v, want %s %v", i, wait, ok, st.wait, st.ok)
+		}
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := newRateLimiter(2)
+	limit := bucketLimit{rate: 1, burst: 1}
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		l.take(key, limit, now)
+	}
+	if l.len() != 2 {
+		t.Fatalf("len = %d, want 2", l.len())
+	}
+	// a was dropped and starts full, c is still empty
+	if _, ok := l.take("a", limit, now); !ok {
+		t.Error("evicted bucket not refilled")
+	}
+	if _, ok := l.take("c", limit, now); ok {
+		t.Error("recent bucket refilled")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		v    string
+		want bucketLimit
+		err  bool
+	}{
+		{v: "5", want: bucketLimit{rate: 5}},
+		{v: "0.5, 10", want: bucketLimit{rate: 0.5, burst: 10}},
+		{v: "x", err: true},
+		{v: "1,1.5", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.v)
+		if (err != nil) != tt.err || (!tt.err && got != tt.want) {
+			t.Errorf("parseRateLimit(%q) = %+v %v, want %+v err %v", tt.v, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLimitKind(t *testing.T) {
+	tests := []struct {
+		uri     string
+		backend string
+		want    string
+	}{
+		{uri: "/index.php?do=search&story=x", backend: backendDle, want: limitSearch},
+		{uri: "/index.php?do=feedback", backend: backendDle, want: backendDle},
+		{uri: "/resize/?url=x", backend: backendImaginary, want: limitResize},
+		{uri: "/crop/small?url=x", backend: backendImaginary, want: limitResize},
+		{uri: "/posts/a.jpg?do=search", backend: backendImager, want: backendImager},
+		{uri: "/traefik", backend: backendDns, want: backendDns},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+		if got := limitKind(r, &backend{name: tt.backend}); got != tt.want {
+			t.Errorf("limitKind(%s, %s) = %s, want %s", tt.uri, tt.backend, got, tt.want)
+		}
+	}
+}
+
+func TestLimitAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "203.0.113.7", want: "203.0.113.7"},
+		{addr: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::"},
+		{addr: "2001:db8:1:2:ffff::1", want: "2001:db8:1:2::"},
+	}
+	for _, tt := range tests {
+		if got := limitAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("limitAddr(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	s := &Service{
+		metrics: newMetricSet(),
+		limiter: newRateLimiter(100),
+		rateLimits: map[string]bucketLimit{
+			limitSearch:          {rate: 0.001, burst: 1},
+			limitSearch + " bot": {rate: 0.001, burst: 2},
+			limitAll:             {rate: 0.001, burst: 3},
+		},
+		rateLimitAllow: parsePrefixes([]string{"192.0.2.0/24"}),
+	}
+
+	dom := domain.Domain{HostPublic: "example.com"}
+
+	tests := []struct {
+		name   string
+		ip     string
+		class  string
+		kind   string
+		limits []bool
+	}{
+		{name: "kind limit", ip: "203.0.113.1", class: "human", kind: limitSearch, limits: []bool{false, true}},
+		{name: "class limit", ip: "203.0.113.2", class: "bot", kind: limitSearch, limits: []bool{false, false, true}},
+		{name: "class change keeps bucket", ip: "203.0.113.1", class: "bot", kind: limitSearch, limits: []bool{true}},
+		{name: "all limit", ip: "203.0.113.3", class: "human", kind: backendDle, limits: []bool{false, false, false, true}},
+		{name: "same /64", ip: "2001:db8::1", class: "human", kind: limitSearch, limits: []bool{false}},
+		{name: "same /64 other addr", ip: "2001:db8::2", class: "human", kind: limitSearch, limits: []bool{true}},
+		{name: "allowlist", ip: "192.0.2.9", class: "human", kind: limitSearch, limits: []bool{false, false, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client{ip: netip.MustParseAddr(tt.ip)}
+			for i, want := range tt.limits {
+				w := httptest.NewRecorder()
+				got := s.rateLimited(w, dom, c, tt.class, tt.kind, "req")
+				if got != want {
+					t.Fatalf("request %d: limited = %v, want %v", i, got, want)
+				}
+				if got && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+					t.Errorf("request %d: %d Retry-After %q", i, w.Code, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
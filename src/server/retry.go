@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// retryBudget limits retries to a share of traffic: every request deposits ratio tokens,
+// every retry spends one. Keeps retries from multiplying load on a backend that is already down.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isConnError reports failures where the backend never got the request: refused, reset, dropped keep-alive
+func isConnError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout()
+}
+
+func isIdempotent(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && (r.Body == nil || r.Body == http.NoBody)
+}
+
+// roundTrip sends proxyReq to an upstream picked from the pool through its circuit breaker,
+// retrying idempotent requests on connection errors on another upstream with exponential backoff.
+// uri is appended to the upstream url.
+func (s *Service) roundTrip(be *backend, p *pool, uri string, proxyReq *http.Request) (*http.Response, error) {
+	s.retryBudget.deposit()
+
+	var prev *upstream
+	for attempt := 0; ; attempt++ {
+		up := p.pick(s, uri, prev)
+		if up == nil {
+			return nil, errNoUpstream
+		}
+		prev = up
+
+		b := s.breaker(be.name, up.url)
+		ticket, ok := b.allow()
+		if !ok {
+			s.metrics.inc("dle_proxy_breaker_rejected_total", "backend", be.name)
+			return nil, errBreakerOpen
+		}
+
+		target, err := url.Parse(up.url + uri)
+		if err != nil {
+			b.release(ticket)
+			return nil, err
+		}
+		req := proxyReq.Clone(proxyReq.Context())
+		req.URL = target
+
+		up.active.Add(1)
+		resp, err := be.transport.RoundTrip(req)
+		if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			// 101 body must stay io.ReadWriteCloser for the tunnel
+			up.active.Add(-1)
+		} else {
+			resp.Body = &activeBody{ReadCloser: resp.Body, up: up}
+		}
+
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			b.success(ticket)
+			return resp, nil
+		}
+		if ctxErr := proxyReq.Context().Err(); ctxErr != nil {
+			// request deadline is the upstream being slow, client gone is nobody's fault
+			if errors.Is(ctxErr, context.DeadlineExceeded) {
+				b.failure(ticket)
+			} else {
+				b.release(ticket)
+			}
+			return resp, err
+		}
+		b.failure(ticket)
+		if err == nil {
+			// 5xx is passed to the client as is
+			return resp, nil
+		}
+
+		if attempt >= s.retryAttempts || !isIdempotent(proxyReq) || !isConnError(err) || !s.retryBudget.withdraw() {
+			return nil, err
+		}
+		s.metrics.inc("dle_proxy_upstream_retries_total", "backend", be.name)
+
+		backoff := s.retryBackoff << attempt
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		select {
+		case <-proxyReq.Context().Done():
+			return nil, proxyReq.Context().Err()
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is supported on linux only")
+}
@@ -1,51 +1,344 @@
 package server
 
 import (
+	"context"
 	"dle-proxy/database"
+	"dle-proxy/database/accessList"
 	"dle-proxy/database/domain"
 	"dle-proxy/database/domainAlias"
+	"dle-proxy/database/domainErrorPage"
 	"dle-proxy/database/domainFile"
+	"dle-proxy/database/domainGeo"
 	"dle-proxy/database/flixPost"
+	"dle-proxy/database/protectedPath"
+	"dle-proxy/database/rateLimit"
+	"dle-proxy/database/wafRule"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Service struct {
-	port               string
-	server             http.Server
-	dbService          *database.Service
-	domainService      *domain.Service
-	domainAliasService *domainAlias.Service
-	fileService        *domainFile.Service
-	flixPostService    *flixPost.Service
-	customTransport    http.RoundTripper
-}
-
-func (s *Service) Run() {
-	addr := fmt.Sprintf(":%s", s.port)
-	log.Println("Starting proxy server on", addr)
-	err := s.server.ListenAndServe()
+	mu                   sync.Mutex
+	port                 string
+	server               http.Server
+	tlsServer            *http.Server
+	listeners            map[string]net.Listener
+	reusePort            bool
+	drainTimeout         time.Duration
+	handoffTimeout       time.Duration
+	dbService            *database.Service
+	domainService        *domain.Service
+	domainAliasService   *domainAlias.Service
+	fileService          *domainFile.Service
+	flixPostService      *flixPost.Service
+	errorPageService     *domainErrorPage.Service
+	rateLimitService     *rateLimit.Service
+	accessListService    *accessList.Service
+	asnDB                *mmdbFile
+	geoService           *domainGeo.Service
+	geoDB                *mmdbFile
+	protectedPathService *protectedPath.Service
+	authSecret           []byte
+	authCookieTTL        time.Duration
+	wafService           *wafRule.Service
+	wafStarter           []*wafRule.WafRule
+	wafDryRun            bool
+	challengeCookieTTL   time.Duration
+	challengeOff         bool // no AUTH_SECRET, see warnChallengeSecret
+	hotlinkAllow         []string
+	hotlinkPlaceholder   placeholderImage
+	headerPolicies       *headerPolicies
+	corsPolicies         *corsPolicies
+	tarpitSlots          chan struct{}
+	tarpitDelay          time.Duration
+	backends             map[string]*backend
+	ctx                  context.Context
+	poolsMu              sync.Mutex
+	pools                map[string]*pool
+	breakersMu           sync.Mutex
+	breakers             map[string]*breaker
+	breakerFailures      int
+	breakerOpenTime      time.Duration
+	retryBudget          *retryBudget
+	retryAttempts        int
+	retryBackoff         time.Duration
+	metrics              *metricSet
+	trustedProxies       []netip.Prefix
+	cloudflareProxies    []netip.Prefix
+	botVerifier          *botVerifier
+	fakeBotAction        string
+	limiter              *rateLimiter
+	rateLimits           map[string]bucketLimit
+	rateLimitAllow       []netip.Prefix
+	staleCache           *responseCache
+	staleSkipCookies     []string
+	adminToken           string
+	adminHandler         http.Handler
+	traefik              traefikSettings
+	exportUpstream       string
+	exportListen         string
+}
+
+type traefikSettings struct {
+	service      string
+	entryPoints  []string
+	certResolver string
+	tls          bool
+	file         string
+	filePeriod   time.Duration
+}
+
+// Run serves until ctx is done, then stops accepting and waits up to SHUTDOWN_TIMEOUT for in-flight requests
+func (s *Service) Run(ctx context.Context) error {
+	errc := make(chan error, 2)
+
+	ln, err := s.listen("http", s.server.Addr)
 	if err != nil {
-		log.Fatal("Error starting proxy server: ", err)
+		return err
+	}
+	s.mu.Lock()
+	s.listeners["http"] = ln
+	s.mu.Unlock()
+	log.Println("Starting proxy server on", ln.Addr())
+	go func() {
+		errc <- s.server.Serve(ln)
+	}()
+
+	if s.tlsServer != nil {
+		tln, err := s.listen("https", s.tlsServer.Addr)
+		if err != nil {
+			// http is already serving, don't leave it behind
+			s.server.Close()
+			return err
+		}
+		s.mu.Lock()
+		s.listeners["https"] = tln
+		s.mu.Unlock()
+		log.Println("Starting tls proxy server on", tln.Addr())
+		go func() {
+			errc <- s.tlsServer.ServeTLS(tln, "", "")
+		}()
+	}
+
+	notifyReady()
+
+	select {
+	case err := <-errc:
+		// one of the servers failed, stop the other one too
+		s.server.Close()
+		if s.tlsServer != nil {
+			s.tlsServer.Close()
+		}
+		return err
+	case <-ctx.Done():
 	}
+
+	log.Println("shutting down, drain timeout", s.drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	if s.tlsServer != nil {
+		if err := s.tlsServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("tls server shutdown", err)
+		}
+	}
+	return s.server.Shutdown(shutdownCtx)
 }
 
-func NewService(port string, dbService *database.Service, domainService *domain.Service, domainAliasService *domainAlias.Service, fileService *domainFile.Service, flixPostService *flixPost.Service) (s *Service, err error) {
+func NewService(ctx context.Context, port string, dbService *database.Service, domainService *domain.Service, domainAliasService *domainAlias.Service, fileService *domainFile.Service, flixPostService *flixPost.Service, errorPageService *domainErrorPage.Service, rateLimitService *rateLimit.Service, accessListService *accessList.Service, geoService *domainGeo.Service, protectedPathService *protectedPath.Service, wafService *wafRule.Service) (s *Service, err error) {
 
 	s = &Service{
-		port:               port,
-		dbService:          dbService,
-		domainService:      domainService,
-		domainAliasService: domainAliasService,
-		fileService:        fileService,
-		flixPostService:    flixPostService,
-		customTransport:    http.DefaultTransport,
+		port:                 port,
+		dbService:            dbService,
+		domainService:        domainService,
+		domainAliasService:   domainAliasService,
+		fileService:          fileService,
+		flixPostService:      flixPostService,
+		errorPageService:     errorPageService,
+		rateLimitService:     rateLimitService,
+		accessListService:    accessListService,
+		geoService:           geoService,
+		protectedPathService: protectedPathService,
+		authSecret:           authSecret(),
+		authCookieTTL:        envDuration("AUTH_COOKIE_TTL", 12*time.Hour),
+		wafService:           wafService,
+		wafStarter:           compileStarterRules(),
+		wafDryRun:            os.Getenv("WAF_DRY_RUN") == "1",
+		challengeCookieTTL:   envDuration("CHALLENGE_TTL", 24*time.Hour),
+		challengeOff:         envString("AUTH_SECRET", "") == "",
+		hotlinkAllow:         envList("HOTLINK_ALLOW"),
+		hotlinkPlaceholder:   loadPlaceholder(),
+		headerPolicies:       newHeaderPolicies(),
+		corsPolicies:         newCorsPolicies(),
+		tarpitSlots:          make(chan struct{}, envInt("TARPIT_MAX", 256)),
+		tarpitDelay:          envDuration("TARPIT_DELAY", 30*time.Second),
+		ctx:                  ctx,
+		backends:             map[string]*backend{},
+		pools:                map[string]*pool{},
+		breakers:             map[string]*breaker{},
+		breakerFailures:      envInt("BREAKER_FAILURES", 5),
+		breakerOpenTime:      envDuration("BREAKER_OPEN_TIME", 30*time.Second),
+		retryBudget: &retryBudget{
+			ratio:  envFloat("RETRY_BUDGET_RATIO", 0.2),
+			max:    float64(envInt("RETRY_BUDGET_MAX", 100)),
+			tokens: float64(envInt("RETRY_BUDGET_MAX", 100)),
+		},
+		retryAttempts:     envInt("RETRY_ATTEMPTS", 2),
+		retryBackoff:      envDuration("RETRY_BACKOFF", 50*time.Millisecond),
+		metrics:           newMetricSet(),
+		trustedProxies:    parsePrefixes(strings.Split(envString("TRUSTED_PROXIES", "loopback,private"), ",")),
+		cloudflareProxies: parsePrefixes(strings.Split(envString("CLOUDFLARE_PROXIES", "cloudflare"), ",")),
+		botVerifier:       newBotVerifier(),
+		fakeBotAction:     envString("BOT_FAKE_ACTION", "block"),
+		limiter:           newRateLimiter(envInt("RATE_LIMIT_BUCKETS", 100000)),
+		rateLimits:        envRateLimits(),
+		rateLimitAllow:    parsePrefixes(envList("RATE_LIMIT_ALLOWLIST")),
+		listeners:         map[string]net.Listener{},
+		reusePort:         os.Getenv("REUSEPORT") == "1",
+		drainTimeout:      envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		handoffTimeout:    envDuration("HANDOFF_TIMEOUT", time.Minute),
+		adminToken:        os.Getenv("ADMIN_TOKEN"),
+		traefik: traefikSettings{
+			service:      envString("TRAEFIK_SERVICE", "cis-proxy@docker"),
+			entryPoints:  envList("TRAEFIK_ENTRYPOINTS"),
+			certResolver: os.Getenv("TRAEFIK_CERT_RESOLVER"),
+			tls:          os.Getenv("TRAEFIK_TLS") == "1",
+			file:         os.Getenv("TRAEFIK_FILE"),
+			filePeriod:   envDuration("TRAEFIK_FILE_PERIOD", time.Minute),
+		},
+	}
+	if path := os.Getenv("ASN_DB"); path != "" {
+		s.asnDB = newMMDBFile(ctx, path)
+	}
+	if path := os.Getenv("GEOIP_DB"); path != "" {
+		s.geoDB = newMMDBFile(ctx, path)
+	}
+	s.exportUpstream = envString("EXPORT_UPSTREAM", "127.0.0.1:"+port)
+	s.exportListen = envString("EXPORT_LISTEN", "80")
+	if envInt("STALE_CACHE_SIZE", 64<<20) > 0 {
+		s.staleCache = &responseCache{
+			memory: map[string]*lru{},
+			memoryQuota: func(kind string) int64 {
+				return cacheQuota("STALE_CACHE_SIZE", kind, 64<<20)
+			},
+		}
+		if dir := os.Getenv("STALE_CACHE_DIR"); dir != "" {
+			diskQuota := func(kind string) int64 {
+				return cacheQuota("STALE_CACHE_DISK_SIZE", kind, 1<<30)
+			}
+			rewrite := envDuration("STALE_CACHE_DISK_REWRITE", 5*time.Minute)
+			if s.staleCache.disk, err = newDiskStore(dir, diskQuota, rewrite); err != nil {
+				return
+			}
+		}
+		s.staleSkipCookies = dleAuthCookies
+		if list := envList("STALE_SKIP_COOKIES"); len(list) > 0 {
+			s.staleSkipCookies = list
+		}
+	}
+
+	s.metrics.describe("dle_proxy_stale_served_total", "counter", "Stored responses served because the upstream failed.")
+	s.metrics.describe("dle_proxy_cache_hits_total", "counter", "Stored responses served while fresh by their Cache-Control.")
+	s.metrics.describe("dle_proxy_upstream_retries_total", "counter", "Retried upstream requests.")
+	s.metrics.describe("dle_proxy_breaker_rejected_total", "counter", "Requests rejected by open circuit breaker.")
+	s.metrics.describe("dle_proxy_requests_total", "counter", "Requests to known domains by client class.")
+	s.metrics.describe("dle_proxy_access_denied_total", "counter", "Requests denied by access lists.")
+	s.metrics.describe("dle_proxy_geo_total", "counter", "Requests blocked or redirected by country rules.")
+	s.metrics.describe("dle_proxy_protected_denied_total", "counter", "Requests to protected paths denied or sent to login.")
+	s.metrics.describe("dle_proxy_waf_total", "counter", "Requests matched by waf rules.")
+	s.metrics.describe("dle_proxy_challenge_total", "counter", "Challenge pages issued, passed, failed and refused to non-navigation requests.")
+	s.metrics.describe("dle_proxy_hotlink_blocked_total", "counter", "Image requests blocked by hotlink protection.")
+	s.metrics.describe("dle_proxy_rate_limited_total", "counter", "Requests answered 429 by rate limit.")
+	s.metrics.describe("dle_proxy_breaker_state", "gauge", "Circuit breaker state per upstream.")
+	s.metrics.describe("dle_proxy_upstream_healthy", "gauge", "Active health check result per upstream.")
+	s.metrics.describe("dle_proxy_upstream_active", "gauge", "Requests in flight per upstream.")
+	s.adminHandler = s.newAdminHandler()
+	for _, name := range backendNames {
+		s.backends[name] = newBackend(name)
 	}
 	s.server = http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
-		Handler: http.HandlerFunc(s.Proxy),
+		Addr:              fmt.Sprintf(":%s", port),
+		Handler:           http.HandlerFunc(s.Proxy),
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 60*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 120*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+	}
+
+	s.warnChallengeSecret()
+
+	if httpsPort := os.Getenv("HTTPS_PORT"); httpsPort != "" {
+		if err = s.setupTLS(httpsPort); err != nil {
+			return
+		}
 	}
 
+	if s.traefik.file != "" {
+		go s.traefikFileWorker(ctx)
+	}
+	go s.poolWorker(ctx)
+
+	return
+}
+
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+		log.Printf("bad %s=%s: %s", name, v, err)
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil {
+			return i
+		}
+		log.Printf("bad %s=%s: %s", name, v, err)
+	}
+	return def
+}
+
+// cacheQuota reads <name>_<KIND>, falling back to <name> and def
+func cacheQuota(name, kind string, def int) int64 {
+	return int64(envInt(name+"_"+strings.ToUpper(kind), envInt(name, def)))
+}
+
+func envFloat(name string, def float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return f
+		}
+		log.Printf("bad %s=%s: %s", name, v, err)
+	}
+	return def
+}
+
+// envList splits comma separated env value, empty items are dropped
+func envList(name string) (list []string) {
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
 	return
 }
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dle login and session cookies, pages for logged in users are never stored. STALE_SKIP_COOKIES replaces the list.
+var dleAuthCookies = []string{"dle_user_id", "dle_password", "PHPSESSID"}
+
+// headers of our own, not stored with the page. cors headers depend on the request Origin,
+// cookies set for an anonymous visitor (PHPSESSID) must not be handed to the next one.
+var staleSkipHeaders = []string{"X-Request-Id", "X-Proxy-Tm", "Set-Cookie", "Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"}
+
+// proxyVaryHeaders are request headers set by the proxy that the upstream may render by, part of staleKey
+var proxyVaryHeaders = []string{"X-Country", "X-Client-Class"}
+
+// staleKey is the stored response key: the page as rendered for a country (X-Country) and client class (X-Client-Class)
+func staleKey(dom domain.Domain, uri, country, class string) string {
+	return fmt.Sprintf("%d %s %s %s", dom.ID, country, class, uri)
+}
+
+// storeStale keeps the last good anonymous GET response of the domain (flix_domain.stale_max_age > 0).
+// kind is the route kind (backend name), every kind has its own cache quota.
+func (s *Service) storeStale(r *http.Request, dom domain.Domain, kind, key string, status int, header http.Header, body []byte) {
+	if s.staleCache == nil || dom.StaleMaxAge <= 0 || r.Method != http.MethodGet || status != http.StatusOK {
+		return
+	}
+	if strings.Contains(header.Get("Cache-Control"), "private") {
+		return
+	}
+	if s.hasSkipCookie(r) {
+		return
+	}
+
+	h := header.Clone()
+	for _, name := range staleSkipHeaders {
+		h.Del(name)
+	}
+	s.staleCache.set(kind, key, &cacheEntry{Status: status, Header: h, Body: body, Stored: time.Now()})
+}
+
+// hasSkipCookie reports a logged in user, STALE_SKIP_COOKIES
+func (s *Service) hasSkipCookie(r *http.Request) bool {
+	for _, name := range s.staleSkipCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// freshLifetime is how long a stored response may be served without asking the upstream:
+// s-maxage or max-age of its Cache-Control, 0 when it must be revalidated or varies by more than
+// Accept-Encoding, proxyVaryHeaders (and Accept, when the negotiated image format is part of the key).
+func freshLifetime(h http.Header, varyAccept bool) time.Duration {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "Accept-Encoding" || (name == "Accept" && varyAccept) || slices.Contains(proxyVaryHeaders, name) {
+				continue
+			}
+			return 0
+		}
+	}
+	var maxAge, sMaxAge = -1, -1
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+			switch name {
+			case "no-store", "no-cache", "private", "must-revalidate":
+				return 0
+			case "max-age":
+				maxAge, _ = strconv.Atoi(value)
+			case "s-maxage":
+				sMaxAge, _ = strconv.Atoi(value)
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+	return time.Duration(maxAge) * time.Second
+}
+
+// serveFresh answers anonymous GET from the stored response while the upstream's Cache-Control allows,
+// so the tier saves upstream work and not only covers failures
+func (s *Service) serveFresh(w http.ResponseWriter, r *http.Request, dom domain.Domain, kind, key string, varyAccept bool, requestID string) bool {
+	if s.staleCache == nil || dom.StaleMaxAge <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") || s.hasSkipCookie(r) {
+		return false
+	}
+	e, ok := s.staleCache.get(kind, key)
+	if !ok {
+		return false
+	}
+	age := time.Since(e.Stored)
+	if age >= freshLifetime(e.Header, varyAccept) {
+		return false
+	}
+
+	s.metrics.inc("dle_proxy_cache_hits_total", "domain", dom.HostPublic, "kind", kind)
+	s.writeCached(w, r, dom, e, age, requestID)
+	return true
+}
+
+// serveStale answers with the stored response when the upstream failed, false if there is nothing fresh enough
+func (s *Service) serveStale(w http.ResponseWriter, r *http.Request, dom domain.Domain, kind, key, requestID string, reason error) bool {
+	if s.staleCache == nil || dom.StaleMaxAge <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	e, ok := s.staleCache.get(kind, key)
+	if !ok {
+		return false
+	}
+	age := time.Since(e.Stored)
+	if age > time.Duration(dom.StaleMaxAge)*time.Second {
+		return false
+	}
+
+	log.Printf("%s (%s) %s STALE %ds: %s\n", r.Method, dom.HostPublic, r.URL.String(), int(age.Seconds()), reason)
+	s.metrics.inc("dle_proxy_stale_served_total", "domain", dom.HostPublic, "kind", kind)
+
+	w.Header().Set("X-Proxy-Stale", "1")
+	w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	s.writeCached(w, r, dom, e, age, requestID)
+	return true
+}
+
+// writeCached sends stored response e, headers already in w that aren't X-Proxy-* or Warning are dropped
+func (s *Service) writeCached(w http.ResponseWriter, r *http.Request, dom domain.Domain, e *cacheEntry, age time.Duration, requestID string) {
+	h := w.Header()
+	for name := range h {
+		if name != "X-Proxy-Stale" && name != "Warning" {
+			delete(h, name)
+		}
+	}
+	for name, values := range e.Header {
+		h[name] = values
+	}
+	s.corsHeaders(h, r, dom)
+	h.Set("X-Request-Id", requestID)
+	h.Set("Age", fmt.Sprintf("%d", int(age.Seconds())))
+	h.Set("Content-Length", fmt.Sprintf("%d", len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
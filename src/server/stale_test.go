@@ -0,0 +1,80 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStoreStale(t *testing.T) {
+	s := &Service{
+		staleCache: &responseCache{
+			memory:      map[string]*lru{},
+			memoryQuota: func(kind string) int64 { return 1 << 20 },
+		},
+		staleSkipCookies: dleAuthCookies,
+	}
+	dom := domain.Domain{ID: 1, StaleMaxAge: 60}
+
+	tests := []struct {
+		name   string
+		cookie string
+		header http.Header
+		stored bool
+	}{
+		{name: "anonymous", header: http.Header{"Content-Type": {"text/html"}}, stored: true},
+		{name: "session cookie set", header: http.Header{"Set-Cookie": {"PHPSESSID=abc; path=/"}}, stored: true},
+		{name: "private", header: http.Header{"Cache-Control": {"private"}}},
+		{name: "logged in", cookie: "dle_user_id=1", header: http.Header{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/page?n="+url.QueryEscape(tt.name), nil)
+			if tt.cookie != "" {
+				r.Header.Set("Cookie", tt.cookie)
+			}
+			key := staleKey(dom, r.URL.String(), "DE", "human")
+			s.storeStale(r, dom, backendDle, key, http.StatusOK, tt.header, []byte("page"))
+			e, ok := s.staleCache.get(backendDle, key)
+			if ok != tt.stored {
+				t.Fatalf("stored = %v, want %v", ok, tt.stored)
+			}
+			if ok && e.Header.Get("Set-Cookie") != "" {
+				t.Errorf("Set-Cookie stored: %q", e.Header.Get("Set-Cookie"))
+			}
+			if _, ok := s.staleCache.get(backendDle, staleKey(dom, r.URL.String(), "US", "human")); ok {
+				t.Error("page of one country served to another")
+			}
+			if _, ok := s.staleCache.get(backendDle, staleKey(dom, r.URL.String(), "DE", "bot")); ok {
+				t.Error("page of one client class served to another")
+			}
+		})
+	}
+}
+
+func TestFreshLifetimeVary(t *testing.T) {
+	tests := []struct {
+		vary       string
+		varyAccept bool
+		want       time.Duration
+	}{
+		{vary: "", want: time.Minute},
+		{vary: "Accept-Encoding, X-Country", want: time.Minute},
+		{vary: "x-client-class", want: time.Minute},
+		{vary: "Accept", want: 0},
+		{vary: "Accept", varyAccept: true, want: time.Minute},
+		{vary: "Cookie", want: 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Cache-Control": {"max-age=60"}}
+		if tt.vary != "" {
+			h.Set("Vary", tt.vary)
+		}
+		if got := freshLifetime(h, tt.varyAccept); got != tt.want {
+			t.Errorf("Vary %q accept %v: %s, want %s", tt.vary, tt.varyAccept, got, tt.want)
+		}
+	}
+}
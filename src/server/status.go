@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type statusResponse struct {
+	Breakers    []breakerStatus      `json:"breakers"`
+	Upstreams   []poolUpstreamStatus `json:"upstreams"`
+	RetryBudget float64              `json:"retry_budget"`
+	RateBuckets int                  `json:"rate_limit_buckets"`
+	Domains     int                  `json:"domains"`
+	DomainAlias int                  `json:"domain_aliases"`
+	Listeners   []string             `json:"listeners"`
+}
+
+// statusHandler is /_proxy/status for humans: upstream breakers and what's loaded
+func (s *Service) statusHandler(w http.ResponseWriter, r *http.Request) {
+	st := statusResponse{Breakers: s.breakerStatuses()}
+	sort.Slice(st.Breakers, func(i, j int) bool {
+		if st.Breakers[i].Backend != st.Breakers[j].Backend {
+			return st.Breakers[i].Backend < st.Breakers[j].Backend
+		}
+		return st.Breakers[i].Upstream < st.Breakers[j].Upstream
+	})
+
+	st.Upstreams = s.upstreamStatuses()
+	sort.Slice(st.Upstreams, func(i, j int) bool {
+		if st.Upstreams[i].Backend != st.Upstreams[j].Backend {
+			return st.Upstreams[i].Backend < st.Upstreams[j].Backend
+		}
+		return st.Upstreams[i].URL < st.Upstreams[j].URL
+	})
+
+	s.retryBudget.mu.Lock()
+	st.RetryBudget = s.retryBudget.tokens
+	s.retryBudget.mu.Unlock()
+
+	st.RateBuckets = s.limiter.len()
+
+	domains, _ := s.domainService.GetDomains()
+	st.Domains = len(domains)
+	aliases, _ := s.domainAliasService.GetDomains()
+	st.DomainAlias = len(aliases)
+
+	s.mu.Lock()
+	for name, ln := range s.listeners {
+		st.Listeners = append(st.Listeners, name+" "+ln.Addr().String())
+	}
+	s.mu.Unlock()
+	sort.Strings(st.Listeners)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
@@ -1,22 +1,132 @@
 package server
 
-import "strings"
-
-func (s *Service) traefikConfig() string {
-	tpl := "" +
-		"  [host_]:\n" +
-		"   rule: Host(`[host]`)\n" +
-		"   service: cis-proxy@docker\n"
-
-	domains, _ := s.domainService.GetDomains()
-	result := "http:\n" +
-		" routers:\n"
-	for _, d := range domains {
-		row := tpl
-		row = strings.ReplaceAll(row, "[host]", d.HostPublic)
-		host_ := strings.ReplaceAll(d.HostPublic, ".", "_")
-		row = strings.ReplaceAll(row, "[host_]", host_)
-		result = result + row
-	}
-	return result
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type traefikDynamic struct {
+	HTTP traefikHTTP `yaml:"http"`
+}
+
+type traefikHTTP struct {
+	Routers map[string]traefikRouter `yaml:"routers"`
+}
+
+type traefikRouter struct {
+	Rule        string      `yaml:"rule"`
+	Service     string      `yaml:"service"`
+	EntryPoints []string    `yaml:"entryPoints,omitempty"`
+	TLS         *traefikTLS `yaml:"tls,omitempty"`
+}
+
+type traefikTLS struct {
+	CertResolver string `yaml:"certResolver,omitempty"`
+}
+
+// traefikConfig builds dynamic config with a router per domain, aliases go to the same router
+func (s *Service) traefikConfig() ([]byte, error) {
+	sites, err := s.exportSites()
+	if err != nil {
+		return nil, err
+	}
+	return renderTraefik(s.traefik, sites)
+}
+
+func renderTraefik(settings traefikSettings, sites []exportSite) ([]byte, error) {
+	if err := checkExportNames(append([]string{settings.service}, settings.entryPoints...)...); err != nil {
+		return nil, err
+	}
+	if settings.certResolver != "" {
+		if err := checkExportNames(settings.certResolver); err != nil {
+			return nil, err
+		}
+	}
+	cfg := traefikDynamic{HTTP: traefikHTTP{Routers: map[string]traefikRouter{}}}
+	for _, site := range sites {
+		rules := []string{"Host(`" + site.Host + "`)"}
+		for _, h := range site.Aliases {
+			rules = append(rules, "Host(`"+h+"`)")
+		}
+
+		router := traefikRouter{
+			Rule:        strings.Join(rules, " || "),
+			Service:     settings.service,
+			EntryPoints: settings.entryPoints,
+		}
+		if settings.tls || settings.certResolver != "" {
+			router.TLS = &traefikTLS{CertResolver: settings.certResolver}
+		}
+		cfg.HTTP.Routers[strings.ReplaceAll(site.Host, ".", "_")] = router
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Service) traefikHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := s.traefikConfig()
+	if err != nil {
+		log.Println("traefik config", err)
+		http.Error(w, "Error building traefik config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(cfg)
+}
+
+// traefikFileWorker keeps TRAEFIK_FILE in sync for traefik file provider
+func (s *Service) traefikFileWorker(ctx context.Context) {
+	var last []byte
+	for {
+		cfg, err := s.traefikConfig()
+		if err != nil {
+			log.Println("traefik config", err)
+		} else if !bytes.Equal(cfg, last) {
+			if err := writeFileAtomic(s.traefik.file, cfg); err != nil {
+				log.Println("traefik file", err)
+			} else {
+				log.Println("traefik file updated", s.traefik.file)
+				last = cfg
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.traefik.filePeriod):
+		}
+	}
+}
+
+// writeFileAtomic writes via temp file + rename so readers never see a partial file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
 }
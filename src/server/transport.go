@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backendDle       = "dle"
+	backendImager    = "imager"
+	backendImaginary = "imaginary"
+	backendSitemap   = "sitemap"
+	backendStater    = "stater"
+	backendDns       = "dns"
+)
+
+var backendNames = []string{backendDle, backendImager, backendImaginary, backendSitemap, backendStater, backendDns}
+
+// backend is an upstream kind with its own connection pool and timeouts
+type backend struct {
+	name      string
+	transport *http.Transport
+	timeout   time.Duration // whole request including response body
+}
+
+// newBackend reads UPSTREAM_<NAME>_<SETTING>, falling back to UPSTREAM_<SETTING> and defaults:
+//
+//	DIAL_TIMEOUT=5s TLS_TIMEOUT=5s RESPONSE_HEADER_TIMEOUT=30s KEEPALIVE=30s
+//	MAX_IDLE_CONNS_PER_HOST=32 IDLE_CONN_TIMEOUT=90s REQUEST_TIMEOUT=60s
+func newBackend(name string) *backend {
+	dialer := &net.Dialer{
+		Timeout:   backendDuration(name, "DIAL_TIMEOUT", 5*time.Second),
+		KeepAlive: backendDuration(name, "KEEPALIVE", 30*time.Second),
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   backendDuration(name, "TLS_TIMEOUT", 5*time.Second),
+		ResponseHeaderTimeout: backendDuration(name, "RESPONSE_HEADER_TIMEOUT", 30*time.Second),
+		MaxIdleConnsPerHost:   backendInt(name, "MAX_IDLE_CONNS_PER_HOST", 32),
+		IdleConnTimeout:       backendDuration(name, "IDLE_CONN_TIMEOUT", 90*time.Second),
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	return &backend{
+		name:      name,
+		transport: transport,
+		timeout:   backendDuration(name, "REQUEST_TIMEOUT", 60*time.Second),
+	}
+}
+
+func backendEnv(name, setting string) string {
+	if v := os.Getenv("UPSTREAM_" + strings.ToUpper(name) + "_" + setting); v != "" {
+		return v
+	}
+	return os.Getenv("UPSTREAM_" + setting)
+}
+
+func backendDuration(name, setting string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(backendEnv(name, setting)); err == nil {
+		return d
+	}
+	return def
+}
+
+func backendInt(name, setting string, def int) int {
+	if v, err := strconv.Atoi(backendEnv(name, setting)); err == nil {
+		return v
+	}
+	return def
+}
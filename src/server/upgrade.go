@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// connectionHeaders returns headers listed in Connection, they are hop-by-hop too
+func connectionHeaders(h http.Header) map[string]bool {
+	listed := map[string]bool{}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				listed[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return listed
+}
+
+// upgradeType returns Upgrade protocol (websocket) when the request asks for a protocol switch
+func upgradeType(h http.Header) string {
+	if !connectionHeaders(h)["Upgrade"] {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// serveUpgrade tunnels bytes between client and backend after 101 Switching Protocols
+func (s *Service) serveUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	reqUpgrade := upgradeType(r.Header)
+	resUpgrade := upgradeType(resp.Header)
+	if !strings.EqualFold(reqUpgrade, resUpgrade) {
+		resp.Body.Close()
+		log.Printf("upgrade: backend switched to %q instead of %q\n", resUpgrade, reqUpgrade)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		log.Println("upgrade: backend body is not writable")
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Println("upgrade: hijack", err)
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// server read/write timeouts are for requests, not for long lived tunnels
+	conn.SetDeadline(time.Time{})
+
+	header := http.Header{}
+	listed := connectionHeaders(resp.Header)
+	for name, values := range resp.Header {
+		if isHopHeader(name) || listed[name] {
+			continue
+		}
+		header[name] = values
+	}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", resUpgrade)
+	applyHeaderPolicy(w, header)
+
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Println("upgrade: write response", err)
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		// brw.Reader may hold bytes the client sent right after the request
+		_, err := io.Copy(backConn, brw)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backConn)
+		errc <- err
+	}()
+	<-errc
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"dle-proxy/database/wafRule"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wafStarterRules catch common dle exploit probes, checked after flix_waf_rules unless WAF_STARTER=0
+var wafStarterRules = []*wafRule.WafRule{
+	{
+		Name:   "sqli",
+		Query:  `(?i)(union(\s|/\*.*?\*/|\+)+(all(\s|\+)+)?select|select.+from.+information_schema|\b(sleep|benchmark|extractvalue|updatexml|load_file)\s*\(|into\s+(out|dump)file|'\s*(or|and)\s+'?\d+'?\s*=\s*'?\d+)`,
+		Action: "block",
+	},
+	{
+		Name:   "upload-php",
+		Path:   `(?i)^/uploads/.*\.(php\d?|phtml|phar|pht|inc)(/|$)`,
+		Action: "block",
+	},
+	{
+		Name:   "traversal",
+		Query:  `(\.\./|\.\.\\|\x00)`,
+		Action: "block",
+	},
+	{
+		Name:   "traversal-path",
+		Path:   `(\.\./|\.\.\\|\x00)`,
+		Action: "block",
+	},
+	{
+		Name:   "dle-config-leak",
+		Path:   `^/engine/classes/min/index\.php`,
+		Query:  `(?i)(^|&)f=.*(dbconfig|config)\.php`,
+		Action: "block",
+	},
+	{
+		Name:   "sensitive-files",
+		Path:   `(?i)/(\.env|\.git/|\.svn/|\.htaccess|\.htpasswd|wp-login\.php|wp-admin/|xmlrpc\.php|phpmyadmin|engine/data/[^/]+\.php|backup\.(sql|zip|tar\.gz))`,
+		Action: "block",
+	},
+	{
+		Name:      "scanner",
+		UserAgent: `(?i)(sqlmap|nikto|nmap|masscan|zgrab|acunetix|nessus|wpscan|dirbuster|gobuster|nuclei|jorgee)`,
+		Action:    "block",
+	},
+	{
+		Name:     "search-large-body",
+		Methods:  "POST",
+		Query:    `(^|&)do=search`,
+		BodySize: 64 << 10,
+		Action:   "log",
+	},
+}
+
+// compileStarterRules compiles wafStarterRules once at start
+func compileStarterRules() []*wafRule.WafRule {
+	if envString("WAF_STARTER", "1") != "1" {
+		return nil
+	}
+	for _, rule := range wafStarterRules {
+		if err := rule.Compile(); err != nil {
+			log.Fatal("waf starter rule ", rule.Name, err)
+		}
+	}
+	return wafStarterRules
+}
+
+func newWafRequest(r *http.Request, class string) *wafRule.WafRequest {
+	return &wafRule.WafRequest{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     wafQuery(r.URL.RawQuery),
+		Header:    r.Header,
+		UserAgent: r.UserAgent(),
+		BodySize:  r.ContentLength,
+		Class:     class,
+	}
+}
+
+// wafQuery decodes every name and value on its own, leniently like php does: a broken escape in one
+// parameter stays as is and doesn't leave the others encoded
+func wafQuery(raw string) string {
+	parts := strings.Split(raw, "&")
+	for i, part := range parts {
+		name, value, ok := strings.Cut(part, "=")
+		parts[i] = lenientUnescape(name)
+		if ok {
+			parts[i] += "=" + lenientUnescape(value)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func lenientUnescape(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '+':
+			b.WriteByte(' ')
+		case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(v))
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// waf evaluates domain flix_waf_rules, global ones and starter rules in that order.
+// log rules and rules in dry run (rule DryRun or WAF_DRY_RUN=1) only log and go on,
+// the first other matching rule decides.
+func (s *Service) waf(w http.ResponseWriter, r *http.Request, dom domain.Domain, c client, class, requestID string) bool {
+	var rules []*wafRule.WafRule
+	if s.wafService != nil {
+		rules = s.wafService.GetRules(dom.ID)
+	}
+	rules = append(rules, s.wafStarter...)
+	if len(rules) == 0 {
+		return false
+	}
+
+	req := newWafRequest(r, class)
+	for _, rule := range rules {
+		if !rule.Matches(req) {
+			continue
+		}
+		name := rule.Name
+		if name == "" {
+			name = "rule-" + strconv.Itoa(rule.ID)
+		}
+		dryRun := rule.DryRun || s.wafDryRun
+		s.metrics.inc("dle_proxy_waf_total", "rule", name, "action", rule.Action, "dry_run", strconv.FormatBool(dryRun))
+		log.Printf("%s (%s) %s waf %s %s dry_run=%t %s %q\n", r.Method, dom.HostPublic, r.URL.String(), name, rule.Action, dryRun, c.ip, r.UserAgent())
+		if rule.Action == "log" || dryRun {
+			continue
+		}
+
+		switch rule.Action {
+		case "rate-limit":
+			if rule.Rate <= 0 || containsAddr(s.rateLimitAllow, c.ip) {
+				continue
+			}
+			limit := bucketLimit{rate: rule.Rate, burst: math.Max(1, float64(rule.Burst))}
+			wait, ok := s.limiter.take("waf "+name+" "+limitAddr(c.ip), limit, time.Now())
+			if ok {
+				continue
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.errorPage(w, dom.ID, http.StatusTooManyRequests, requestID)
+		case "challenge":
+			if !s.challenge(w, r, dom, c, class, requestID) {
+				continue
+			}
+		case "block":
+			s.errorPage(w, dom.ID, http.StatusForbidden, requestID)
+		default:
+			// Compile rejects unknown actions, nothing else should get here
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"dle-proxy/database/domain"
+	"dle-proxy/database/wafRule"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestWafStarterRules(t *testing.T) {
+	s := &Service{metrics: newMetricSet(), wafStarter: compileStarterRules()}
+	dom := domain.Domain{HostPublic: "example.com"}
+
+	tests := []struct {
+		name    string
+		method  string
+		uri     string
+		ua      string
+		body    string
+		blocked bool
+	}{
+		{name: "home", uri: "/", blocked: false},
+		{name: "search", uri: "/index.php?do=search&story=union+of+the+select+few", blocked: false},
+		{name: "union select", uri: "/index.php?newsid=1+UNION+ALL+SELECT+1,2,3", blocked: true},
+		{name: "union select comment", uri: "/index.php?newsid=1/**/union/**/select/**/1", blocked: true},
+		{name: "encoded union select", uri: "/index.php?newsid=1%20union%20select%201", blocked: true},
+		{name: "broken escape keeps others decoded", uri: "/index.php?a=%zz&newsid=1%20union%20select%201", blocked: true},
+		{name: "sleep", uri: "/index.php?id=1%20and%20sleep(5)", blocked: true},
+		{name: "or 1=1", uri: "/index.php?login='%20or%201=1", blocked: true},
+		{name: "upload php", uri: "/uploads/posts/shell.php", blocked: true},
+		{name: "upload php path info", uri: "/uploads/x.phtml/a.jpg", blocked: true},
+		{name: "upload image", uri: "/uploads/posts/2024/a.jpg", blocked: false},
+		{name: "traversal query", uri: "/engine/download.php?file=..%2F..%2Fetc%2Fpasswd", blocked: true},
+		{name: "dle config leak", uri: "/engine/classes/min/index.php?charset=utf-8&f=engine/data/dbconfig.php", blocked: true},
+		{name: "dle minifier", uri: "/engine/classes/min/index.php?f=templates/Default/style/styles.css", blocked: false},
+		{name: "env file", uri: "/.env", blocked: true},
+		{name: "git", uri: "/.git/config", blocked: true},
+		{name: "engine data", uri: "/engine/data/config.php", blocked: true},
+		{name: "scanner", uri: "/", ua: "sqlmap/1.7", blocked: true},
+		{name: "large search logged only", method: http.MethodPost, uri: "/index.php?do=search", body: strings.Repeat("a", 65<<10), blocked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.uri, strings.NewReader(tt.body))
+			if tt.ua != "" {
+				r.Header.Set("User-Agent", tt.ua)
+			}
+			w := httptest.NewRecorder()
+			if got := s.waf(w, r, dom, client{}, classHuman, "req"); got != tt.blocked {
+				t.Fatalf("waf = %v, want %v", got, tt.blocked)
+			}
+			if tt.blocked && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", w.Code)
+			}
+		})
+	}
+}
+
+func TestWafActions(t *testing.T) {
+	rules := []*wafRule.WafRule{
+		{Name: "log", Path: "^/logged$", Action: "log"},
+		{Name: "dry", Path: "^/dry$", Action: "block", DryRun: true},
+		{Name: "bots", Path: "^/bots$", Classes: "bot,fake-search-bot", Action: "block"},
+		{Name: "header", Path: "^/header$", HeaderName: "X-Evil", HeaderValue: "^yes$", Action: "block"},
+		{Name: "post", Path: "^/post$", Methods: "post", Action: "block"},
+		{Name: "limit", Path: "^/limited$", Action: "rate-limit", Rate: 0.001, Burst: 1},
+		{Name: "after-log", Path: "^/logged$", Action: "block"},
+	}
+	for _, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			t.Fatal(rule.Name, err)
+		}
+	}
+	s := &Service{metrics: newMetricSet(), limiter: newRateLimiter(100), wafStarter: rules}
+	dom := domain.Domain{HostPublic: "example.com"}
+	ip := netip.MustParseAddr("203.0.113.7")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		class  string
+		header string
+		status int // 0 - passed through
+	}{
+		{name: "log goes on to the next rule", path: "/logged", status: http.StatusForbidden},
+		{name: "dry run", path: "/dry"},
+		{name: "class match", path: "/bots", class: classFakeBot, status: http.StatusForbidden},
+		{name: "class miss", path: "/bots", class: classSearchBot},
+		{name: "header match", path: "/header", header: "yes", status: http.StatusForbidden},
+		{name: "header value miss", path: "/header", header: "no"},
+		{name: "header missing", path: "/header"},
+		{name: "method miss", path: "/post"},
+		{name: "method match", method: http.MethodPost, path: "/post", status: http.StatusForbidden},
+		{name: "rate limit first", path: "/limited"},
+		{name: "rate limit second", path: "/limited", status: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Evil", tt.header)
+			}
+			class := tt.class
+			if class == "" {
+				class = classHuman
+			}
+			w := httptest.NewRecorder()
+			got := s.waf(w, r, dom, client{ip: ip}, class, "req")
+			if got != (tt.status != 0) || (got && w.Code != tt.status) {
+				t.Errorf("waf = %v status %d, want status %d", got, w.Code, tt.status)
+			}
+		})
+	}
+
+	s.wafDryRun = true
+	r := httptest.NewRequest(http.MethodGet, "/bots", nil)
+	if s.waf(httptest.NewRecorder(), r, dom, client{ip: ip}, classBot, "req") {
+		t.Error("WAF_DRY_RUN blocked a request")
+	}
+}